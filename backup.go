@@ -0,0 +1,373 @@
+package gobitcask
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	backupManifestFilename = "BACKUP_MANIFEST"
+	backupManifestVersion  = 1
+)
+
+// BackupManifest describes a backup. A full backup stores every file of the
+// database, an incremental one only the files that are new or have grown
+// since its parent backup.
+type BackupManifest struct {
+	Version  int       `json:"version"`
+	ID       string    `json:"id"`
+	ParentID string    `json:"parent_id,omitempty"` // empty for a full backup
+	Created  time.Time `json:"created"`
+	// Files are the files of the database when the backup was taken.
+	Files []BackupFile `json:"files"`
+	// Removed are the files of the parent backup that were removed since.
+	Removed []string `json:"removed,omitempty"`
+}
+
+type BackupFile struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Checksum uint32 `json:"checksum"` // CRC-32 (IEEE) of the file
+	// Stored is set if the file is stored in this backup, otherwise it's
+	// unchanged since and stored in one of the parent backups.
+	Stored bool `json:"stored"`
+}
+
+// Backup copies the database to dir, which must be empty or not exist yet,
+// while it keeps being used. The backup holds exactly the writes done before
+// Backup was called. Merges are paused meanwhile; files that can't change
+// anymore are hard-linked when dir is on the same file system and copied
+// otherwise.
+func (b *Bitcask) Backup(dir string) (*BackupManifest, error) {
+	return b.backup(dir, nil)
+}
+
+// BackupSince is like Backup, but only stores the files created since the
+// backup described by parent was taken, and records the files removed
+// meanwhile. Data, merge and hint files never change once they are sealed,
+// so only new files and the active segment at the time of parent need to be
+// copied. Restore the backup with RestoreChain.
+func (b *Bitcask) BackupSince(parent *BackupManifest, dir string) (*BackupManifest, error) {
+	return b.backup(dir, parent)
+}
+
+func (b *Bitcask) backup(dir string, parent *BackupManifest) (*BackupManifest, error) {
+	err := createEmptyDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if b.merger != nil {
+		b.merger.lockRunPreempting()
+		defer b.merger.unlockRun()
+	}
+
+	// with merges paused only the active segment can change, the files and
+	// its size are taken under the write lock so that they match.
+	b.mu.Lock()
+	filesName := b.manifest.files()
+	var activeName string
+	var activeSize int
+	if b.activeSegment != nil {
+		activeName = b.activeSegment.GetID()
+		activeSize, err = b.activeSegment.GetOffset()
+	}
+	b.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	created := time.Now()
+	manifest := &BackupManifest{
+		Version: backupManifestVersion,
+		ID:      strconv.FormatInt(created.UnixNano(), 16),
+		Created: created,
+	}
+
+	parentFiles := make(map[string]BackupFile)
+	if parent != nil {
+		manifest.ParentID = parent.ID
+		for _, file := range parent.Files {
+			parentFiles[file.Name] = file
+		}
+	}
+
+	for _, fileName := range filesName {
+		src, dst := path.Join(b.option.DirName, fileName), path.Join(dir, fileName)
+
+		size := int64(activeSize)
+		if fileName != activeName {
+			info, err := os.Stat(src)
+			if err != nil {
+				return nil, err
+			}
+			size = info.Size()
+		}
+
+		if file, ok := parentFiles[fileName]; ok && file.Size == size {
+			delete(parentFiles, fileName)
+			file.Stored = false
+			manifest.Files = append(manifest.Files, file)
+			continue
+		}
+		delete(parentFiles, fileName)
+
+		if fileName == activeName {
+			err = copyFile(src, dst, size)
+		} else {
+			err = linkOrCopyFile(src, dst)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		file, err := checksumFile(dir, fileName)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Files = append(manifest.Files, file)
+	}
+
+	for fileName := range parentFiles {
+		manifest.Removed = append(manifest.Removed, fileName)
+	}
+	sort.Strings(manifest.Removed)
+
+	err = writeBackupManifest(dir, manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// VerifyBackup checks that the files of the backup in dir match its
+// manifest, and returns the manifest. ErrInvalidBackup is returned if they
+// don't.
+func VerifyBackup(dir string) (*BackupManifest, error) {
+	data, err := os.ReadFile(path.Join(dir, backupManifestFilename))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %v is missing", ErrInvalidBackup, backupManifestFilename)
+	} else if err != nil {
+		return nil, err
+	}
+
+	manifest := &BackupManifest{}
+	err = json.Unmarshal(data, manifest)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+
+	if manifest.Version != backupManifestVersion {
+		return nil, fmt.Errorf("%w: unsupported manifest version %v", ErrInvalidBackup, manifest.Version)
+	}
+
+	for _, expected := range manifest.Files {
+		if !expected.Stored {
+			continue
+		}
+
+		file, err := checksumFile(dir, expected.Name)
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: %v is missing", ErrInvalidBackup, expected.Name)
+		} else if err != nil {
+			return nil, err
+		}
+
+		if file != expected {
+			return nil, fmt.Errorf("%w: %v does not match the manifest", ErrInvalidBackup, expected.Name)
+		}
+	}
+
+	return manifest, nil
+}
+
+// Restore verifies the full backup in backupDir and copies it to dirName,
+// which must be empty or not exist yet. The database can then be opened with
+// New.
+func Restore(backupDir, dirName string) error {
+	return RestoreChain([]string{backupDir}, dirName)
+}
+
+// RestoreChain restores a full backup followed by incremental backups, each
+// taken with BackupSince from the manifest of the one before, to dirName.
+// The whole chain is verified before anything is copied.
+func RestoreChain(backupDirs []string, dirName string) error {
+	manifests := make([]*BackupManifest, 0, len(backupDirs))
+	for idx, backupDir := range backupDirs {
+		manifest, err := VerifyBackup(backupDir)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case idx == 0 && manifest.ParentID != "":
+			return fmt.Errorf("%w: %v is not a full backup", ErrInvalidBackup, backupDir)
+		case idx > 0 && manifest.ParentID != manifests[idx-1].ID:
+			return fmt.Errorf("%w: %v doesn't follow %v", ErrInvalidBackup, backupDir, backupDirs[idx-1])
+		}
+
+		manifests = append(manifests, manifest)
+	}
+	if len(manifests) == 0 {
+		return fmt.Errorf("%w: no backup to restore", ErrInvalidBackup)
+	}
+
+	err := createEmptyDir(dirName)
+	if err != nil {
+		return err
+	}
+
+	for idx, manifest := range manifests {
+		for _, fileName := range manifest.Removed {
+			err = os.Remove(path.Join(dirName, fileName))
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, file := range manifest.Files {
+			if !file.Stored {
+				continue
+			}
+
+			// the active segment of the previous backup has grown since
+			dst := path.Join(dirName, file.Name)
+			err = os.RemoveAll(dst)
+			if err != nil {
+				return err
+			}
+
+			err = copyFile(path.Join(backupDirs[idx], file.Name), dst, file.Size)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// every file must now be exactly as it was when the last backup was taken
+	last := manifests[len(manifests)-1]
+	for _, expected := range last.Files {
+		file, err := checksumFile(dirName, expected.Name)
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: %v is missing from the chain", ErrInvalidBackup, expected.Name)
+		} else if err != nil {
+			return err
+		}
+
+		expected.Stored = true
+		if file != expected {
+			return fmt.Errorf("%w: %v does not match the manifest", ErrInvalidBackup, expected.Name)
+		}
+	}
+
+	dirEntries, err := os.ReadDir(dirName)
+	if err != nil {
+		return err
+	}
+
+	return scanManifest(dirEntries).save(dirName)
+}
+
+func createEmptyDir(dir string) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(dirEntries) > 0 {
+		return ErrDirNotEmpty
+	}
+
+	return nil
+}
+
+// writeBackupManifest writes the manifest last and atomically, a backup
+// without one is incomplete.
+func writeBackupManifest(dir string, manifest *BackupManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path.Join(dir, getTmpFilename(backupManifestFilename))
+	err = writeFileSync(tmpPath, data)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, path.Join(dir, backupManifestFilename))
+	if err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+func checksumFile(dir, fileName string) (BackupFile, error) {
+	f, err := os.Open(path.Join(dir, fileName))
+	if err != nil {
+		return BackupFile{}, err
+	}
+	defer f.Close()
+
+	hash := crc32.NewIEEE()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return BackupFile{}, err
+	}
+
+	return BackupFile{
+		Name:     fileName,
+		Size:     size,
+		Checksum: hash.Sum32(),
+		Stored:   true,
+	}, nil
+}
+
+func linkOrCopyFile(src, dst string) error {
+	err := os.Link(src, dst)
+	if err == nil {
+		return nil
+	}
+
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	return copyFile(src, dst, info.Size())
+}
+
+// copyFile copies the first size bytes of src to dst and syncs dst.
+func copyFile(src, dst string, size int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0755)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.CopyN(out, in, size)
+	if err != nil {
+		return err
+	}
+
+	return out.Sync()
+}
@@ -0,0 +1,299 @@
+package gobitcask
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackupAndRestore(t *testing.T) {
+	dirName, backupDir, restoreDir := "./test", "./test-backup", "./test-restore"
+	defer os.RemoveAll(dirName)
+	defer os.RemoveAll(backupDir)
+	defer os.RemoveAll(restoreDir)
+
+	bc, err := New(
+		WithDirName(dirName),
+		WithSegmentSize(128), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 10 * time.Millisecond,
+		}),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+	defer bc.Close()
+
+	for i := 0; i < 100; i++ {
+		key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i)
+		err = bc.Put([]byte(key), []byte(val))
+		assert.Nil(t, err)
+	}
+
+	// keep writing while the backup is taken
+	stopCh := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for i := 0; ; i++ {
+			select {
+			case <-stopCh:
+				return
+			default:
+			}
+
+			err := bc.Put([]byte(fmt.Sprintf("new%v", i)), []byte("val"))
+			assert.Nil(t, err)
+		}
+	}()
+
+	manifest, err := bc.Backup(backupDir)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, manifest.Files)
+
+	close(stopCh)
+	wg.Wait()
+
+	_, err = bc.Backup(backupDir)
+	assert.Equal(t, ErrDirNotEmpty, err)
+
+	err = Restore(backupDir, restoreDir)
+	assert.Nil(t, err)
+
+	restored, err := New(
+		WithDirName(restoreDir),
+		WithSegmentSize(128), // bytes
+		WithRecoveryMode(RecoveryStrict),
+		WithReadOnly(),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, restored)
+	defer restored.Close()
+
+	for i := 0; i < 100; i++ {
+		key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i)
+		fetchedVal, err := restored.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.EqualValues(t, val, fetchedVal)
+	}
+}
+
+func TestVerifyBackup(t *testing.T) {
+	dirName, backupDir := "./test", "./test-backup"
+	defer os.RemoveAll(dirName)
+	defer os.RemoveAll(backupDir)
+
+	bc, err := New(
+		WithDirName(dirName),
+		WithSegmentSize(128), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+
+	for i := 0; i < 20; i++ {
+		key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i)
+		err = bc.Put([]byte(key), []byte(val))
+		assert.Nil(t, err)
+	}
+
+	manifest, err := bc.Backup(backupDir)
+	assert.Nil(t, err)
+	bc.Close() // files may be hard-linked, don't let the database see the damage
+
+	_, err = VerifyBackup(backupDir)
+	assert.Nil(t, err)
+
+	// corrupt a file
+	filePath := path.Join(backupDir, manifest.Files[0].Name)
+	f, err := os.OpenFile(filePath, os.O_WRONLY, 0755)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte{0xff}, 10)
+	assert.Nil(t, err)
+	f.Close()
+
+	_, err = VerifyBackup(backupDir)
+	assert.True(t, errors.Is(err, ErrInvalidBackup))
+
+	err = Restore(backupDir, "./test-restore")
+	assert.True(t, errors.Is(err, ErrInvalidBackup))
+	_, err = os.Stat("./test-restore")
+	assert.True(t, os.IsNotExist(err))
+
+	// remove a file
+	err = os.Remove(filePath)
+	assert.Nil(t, err)
+
+	_, err = VerifyBackup(backupDir)
+	assert.True(t, errors.Is(err, ErrInvalidBackup))
+
+	// an incomplete backup has no manifest
+	err = os.Remove(path.Join(backupDir, backupManifestFilename))
+	assert.Nil(t, err)
+
+	_, err = VerifyBackup(backupDir)
+	assert.True(t, errors.Is(err, ErrInvalidBackup))
+}
+
+func TestBackupAbortsPausedMerge(t *testing.T) {
+	dirName, backupDir := "./test", "./test-backup"
+	defer os.RemoveAll(dirName)
+	defer os.RemoveAll(backupDir)
+
+	bc, err := New(
+		WithDirName(dirName),
+		WithSegmentSize(128), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+	defer bc.Close()
+
+	for i := 0; i < 100; i++ {
+		err = bc.Put([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("val%v", i)))
+		assert.Nil(t, err)
+	}
+
+	bc.PauseMerge()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- bc.Merge(context.Background())
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	backupDone := make(chan error, 1)
+	go func() {
+		_, err := bc.Backup(backupDir)
+		backupDone <- err
+	}()
+
+	select {
+	case err = <-backupDone:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("backup waited for the paused merge")
+	}
+
+	select {
+	case err = <-done:
+		assert.Equal(t, ErrMergeAborted, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("paused merge wasn't aborted")
+	}
+	assert.Empty(t, bc.manifest.MergeFiles)
+	assert.Equal(t, 0, bc.MergeStatus().Failures)
+
+	_, err = VerifyBackup(backupDir)
+	assert.Nil(t, err)
+
+	// the merge can be retried once resumed
+	bc.ResumeMerge()
+	err = bc.Merge(context.Background())
+	assert.Nil(t, err)
+	assert.NotEmpty(t, bc.manifest.MergeFiles)
+
+	for i := 0; i < 100; i++ {
+		key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i)
+		fetchedVal, err := bc.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.EqualValues(t, val, fetchedVal)
+	}
+}
+
+func TestIncrementalBackup(t *testing.T) {
+	dirName, restoreDir := "./test", "./test-restore"
+	backupDirs := []string{"./test-backup0", "./test-backup1", "./test-backup2"}
+	defer os.RemoveAll(dirName)
+	defer os.RemoveAll(restoreDir)
+	for _, backupDir := range backupDirs {
+		defer os.RemoveAll(backupDir)
+	}
+
+	bc, err := New(
+		WithDirName(dirName),
+		WithSegmentSize(128), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 10 * time.Millisecond,
+		}),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+	defer bc.Close()
+
+	expected := make(map[string]string)
+	put := func(from, to int, prefix string) {
+		for i := from; i < to; i++ {
+			key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("%v%v", prefix, i)
+			err := bc.Put([]byte(key), []byte(val))
+			assert.Nil(t, err)
+			expected[key] = val
+		}
+	}
+
+	put(0, 50, "val")
+	full, err := bc.Backup(backupDirs[0])
+	assert.Nil(t, err)
+
+	// overwrite everything and let the merger remove the old segments
+	put(0, 50, "new")
+	<-time.After(200 * time.Millisecond)
+
+	incr1, err := bc.BackupSince(full, backupDirs[1])
+	assert.Nil(t, err)
+	assert.Equal(t, full.ID, incr1.ParentID)
+	assert.NotEmpty(t, incr1.Removed)
+
+	put(50, 60, "val")
+	incr2, err := bc.BackupSince(incr1, backupDirs[2])
+	assert.Nil(t, err)
+	assert.Equal(t, incr1.ID, incr2.ParentID)
+
+	// files that didn't change are not stored again
+	stored := 0
+	for _, file := range incr2.Files {
+		if file.Stored {
+			stored++
+			_, err = os.Stat(path.Join(backupDirs[2], file.Name))
+			assert.Nil(t, err)
+		}
+	}
+	assert.Less(t, stored, len(incr2.Files))
+
+	// a chain must start with a full backup and be in order
+	err = RestoreChain(backupDirs[1:], restoreDir)
+	assert.True(t, errors.Is(err, ErrInvalidBackup))
+	err = RestoreChain([]string{backupDirs[0], backupDirs[2]}, restoreDir)
+	assert.True(t, errors.Is(err, ErrInvalidBackup))
+
+	err = RestoreChain(backupDirs, restoreDir)
+	assert.Nil(t, err)
+
+	restored, err := New(
+		WithDirName(restoreDir),
+		WithRecoveryMode(RecoveryStrict),
+		WithReadOnly(),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, restored)
+	defer restored.Close()
+
+	assert.Equal(t, len(expected), len(restored.ListKeys()))
+	for key, val := range expected {
+		fetchedVal, err := restored.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.EqualValues(t, val, fetchedVal)
+	}
+}
@@ -0,0 +1,166 @@
+package gobitcask
+
+import (
+	"bytes"
+	"time"
+)
+
+// Batch collects writes that are committed atomically: readers and, after a
+// crash, the reopened database see either all of them or none of them.
+type Batch struct {
+	db  *Bitcask
+	ops []*batchOp
+}
+
+type batchOp struct {
+	key    []byte
+	val    []byte
+	delete bool
+}
+
+func (b *Bitcask) NewBatch() *Batch {
+	return &Batch{
+		db: b,
+	}
+}
+
+func (bt *Batch) Put(key, val []byte) {
+	bt.ops = append(bt.ops, &batchOp{
+		key: append([]byte(nil), key...),
+		val: append([]byte(nil), val...),
+	})
+}
+
+func (bt *Batch) Delete(key []byte) {
+	bt.ops = append(bt.ops, &batchOp{
+		key:    append([]byte(nil), key...),
+		delete: true,
+	})
+}
+
+// Commit writes the batch to the active segment followed by a commit record
+// and then applies it to the key dir. The batch is empty afterwards.
+func (bt *Batch) Commit() error {
+	if bt.db.option.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if len(bt.ops) == 0 {
+		return nil
+	}
+
+	bt.db.mu.Lock()
+	defer bt.db.mu.Unlock()
+
+	keys, entries, err := bt.db.writeBatch(bt.ops)
+	if err != nil {
+		return err
+	}
+
+	bt.db.setEntries(keys, entries)
+	bt.ops = nil
+
+	return nil
+}
+
+// writeBatch appends the records of a batch and its commit record to the
+// active segment in a single write. A nil entry is returned for every key
+// deleted by the batch. The caller must hold b.mu.
+func (b *Bitcask) writeBatch(ops []*batchOp) ([][]byte, []*Entry, error) {
+	ts := uint32(time.Now().UnixNano())
+
+	buf := bytes.NewBuffer(nil)
+	offsets := make([]int, 0, len(ops))
+
+	valueSizes := make([]int, 0, len(ops))
+
+	for _, op := range ops {
+		diskEntry := &DiskEntry{
+			Type:  recordDelete,
+			Flags: flagBatch,
+			Ts:    ts,
+			Key:   op.key,
+		}
+		if !op.delete {
+			val, flags, err := b.option.compressValue(op.val)
+			if err != nil {
+				return nil, nil, err
+			}
+			diskEntry.Type, diskEntry.Value = recordPut, val
+			diskEntry.Flags |= flags
+		}
+
+		err := b.option.keys.seal(diskEntry)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		encodedData, err := encode(diskEntry)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		offsets = append(offsets, buf.Len())
+		valueSizes = append(valueSizes, len(diskEntry.Value))
+		buf.Write(encodedData)
+	}
+
+	commitData, err := encode(&DiskEntry{
+		Type:  recordBatchCommit,
+		Ts:    ts,
+		Value: uint32ToBytes(uint32(len(ops))),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	buf.Write(commitData)
+
+	segmentOffset, err := b.append(buf.Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keys := make([][]byte, 0, len(ops))
+	entries := make([]*Entry, 0, len(ops))
+
+	for idx, op := range ops {
+		keys = append(keys, op.key)
+
+		if op.delete {
+			entries = append(entries, nil)
+			continue
+		}
+
+		entries = append(entries, &Entry{
+			FileID:    b.activeSegment.GetID(),
+			ValueSize: valueSizes[idx],
+			ValuePos:  getValuePos(op.key, segmentOffset+offsets[idx]),
+			Timestamp: ts,
+			seq:       nextSeq(),
+		})
+	}
+
+	return keys, entries, nil
+}
+
+// pendingBatch collects the records of a batch while a data file is read, so
+// that a batch torn by a crash is never applied partially.
+type pendingBatch struct {
+	offset      int // offset of the first record of the batch
+	diskEntries []*DiskEntry
+	offsets     []int
+	sizes       []int
+}
+
+func (p *pendingBatch) add(diskEntry *DiskEntry, offset, size int) {
+	p.diskEntries = append(p.diskEntries, diskEntry)
+	p.offsets = append(p.offsets, offset)
+	p.sizes = append(p.sizes, size)
+}
+
+// committedBy reports whether commitEntry commits the whole pending batch.
+func (p *pendingBatch) committedBy(commitEntry *DiskEntry) bool {
+	return p != nil &&
+		len(commitEntry.Value) == 4 &&
+		int(bytesToUint32(commitEntry.Value)) == len(p.diskEntries)
+}
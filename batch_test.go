@@ -0,0 +1,226 @@
+package gobitcask
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatchCommit(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	bc, err := New(
+		WithDirName(dirName),
+		WithSegmentSize(128), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+	defer bc.Close()
+
+	err = bc.Put([]byte("key0"), []byte("val0"))
+	assert.Nil(t, err)
+
+	batch := bc.NewBatch()
+	for i := 1; i < 10; i++ {
+		key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i)
+		batch.Put([]byte(key), []byte(val))
+	}
+	batch.Delete([]byte("key0"))
+
+	// nothing is visible before the batch is committed
+	assert.Equal(t, 1, len(bc.ListKeys()))
+
+	err = batch.Commit()
+	assert.Nil(t, err)
+
+	_, err = bc.Get([]byte("key0"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	for i := 1; i < 10; i++ {
+		key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i)
+		fetchedVal, err := bc.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.EqualValues(t, val, fetchedVal)
+	}
+}
+
+func TestBatchSurvivesRestart(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	opts := []OptFn{
+		WithDirName(dirName),
+		WithSegmentSize(128), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	}
+
+	bc, err := New(opts...)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+
+	batch := bc.NewBatch()
+	for i := 0; i < 10; i++ {
+		key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i)
+		batch.Put([]byte(key), []byte(val))
+	}
+
+	err = batch.Commit()
+	assert.Nil(t, err)
+
+	err = bc.Close()
+	assert.Nil(t, err)
+
+	bc2, err := New(opts...)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc2)
+	defer bc2.Close()
+
+	for i := 0; i < 10; i++ {
+		key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i)
+		fetchedVal, err := bc2.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.EqualValues(t, val, fetchedVal)
+	}
+}
+
+func TestUncommittedBatchIsDropped(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	opts := []OptFn{
+		WithDirName(dirName),
+		WithSegmentSize(1024), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	}
+
+	bc, err := New(opts...)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+
+	err = bc.Put([]byte("key0"), []byte("val0"))
+	assert.Nil(t, err)
+
+	activeSegmentPath := path.Join(dirName, bc.activeSegment.GetID())
+	info, err := os.Stat(activeSegmentPath)
+	assert.Nil(t, err)
+
+	batch := bc.NewBatch()
+	for i := 1; i < 10; i++ {
+		key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i)
+		batch.Put([]byte(key), []byte(val))
+	}
+
+	err = batch.Commit()
+	assert.Nil(t, err)
+
+	err = bc.Close()
+	assert.Nil(t, err)
+
+	// simulate a crash right before the commit record was written
+	commitData, err := encode(&DiskEntry{
+		Type:  recordBatchCommit,
+		Value: uint32ToBytes(9),
+	})
+	assert.Nil(t, err)
+
+	batchInfo, err := os.Stat(activeSegmentPath)
+	assert.Nil(t, err)
+
+	err = os.Truncate(activeSegmentPath, batchInfo.Size()-int64(len(commitData)))
+	assert.Nil(t, err)
+
+	bc2, err := New(opts...)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc2)
+
+	assert.Equal(t, 1, len(bc2.ListKeys()))
+
+	// the uncommitted batch is cut off so that later writes don't follow it
+	truncatedInfo, err := os.Stat(activeSegmentPath)
+	assert.Nil(t, err)
+	assert.Equal(t, info.Size(), truncatedInfo.Size())
+
+	err = bc2.Put([]byte("key10"), []byte("val10"))
+	assert.Nil(t, err)
+
+	err = bc2.Close()
+	assert.Nil(t, err)
+
+	bc3, err := New(opts...)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc3)
+	defer bc3.Close()
+
+	assert.Equal(t, 2, len(bc3.ListKeys()))
+
+	fetchedVal, err := bc3.Get([]byte("key10"))
+	assert.Nil(t, err)
+	assert.EqualValues(t, "val10", fetchedVal)
+}
+
+func TestBatchIsAtomicForReaders(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	bc, err := New(
+		WithDirName(dirName),
+		WithSegmentSize(1024), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+	defer bc.Close()
+
+	stopCh := make(chan struct{})
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for {
+			select {
+			case <-stopCh:
+				return
+			default:
+			}
+
+			vals := make(map[string]string)
+			err := bc.Fold(func(key, val []byte) error {
+				vals[string(key)] = string(val)
+				return nil
+			})
+			assert.Nil(t, err)
+			assert.Equal(t, vals["key1"], vals["key2"])
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		val := fmt.Sprintf("val%v", i)
+
+		batch := bc.NewBatch()
+		batch.Put([]byte("key1"), []byte(val))
+		batch.Put([]byte("key2"), []byte(val))
+
+		err = batch.Commit()
+		assert.Nil(t, err)
+	}
+
+	close(stopCh)
+	wg.Wait()
+}
@@ -2,35 +2,73 @@ package gobitcask
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"hash/crc32"
-	"io/fs"
+	"log"
 	"os"
 	"path"
+	"slices"
+	"sort"
+	"sync"
 	"time"
 )
 
+// Bitcask is safe for concurrent use. Writers are serialized by mu, which
+// guards the active segment, while readers only go through the KeyDir and
+// the set of opened segments and therefore never block each other.
 type Bitcask struct {
-	option         *Option
+	option *Option
+
+	mu            sync.Mutex
+	activeSegment *Segment
+	manifest      *manifest
+
+	segmentsMu     sync.RWMutex
 	openedSegments map[string]*Segment
-	activeSegment  *Segment
-	keyDir         *KeyDir
-	merger         *Merger
+
+	keyDir KeyDir
+	merger *Merger
+	lock   *dirLock
+
+	stats map[string]*fileStats // by file name, guarded by mu
+
+	// pins keeps the files that iterators and snapshots may read from. Files
+	// the merger is done with are only removed once every pin taken before
+	// is released.
+	pinsMu      sync.Mutex
+	pinSeq      uint64
+	pins        map[uint64]struct{}
+	unusedFiles []unusedFile
+
+	syncStopCh chan struct{}
+	syncWg     sync.WaitGroup
 }
 
 func New(optsFn ...OptFn) (*Bitcask, error) {
-	opts := &Option{}
+	opts := &Option{
+		Logger: log.Default(),
+	}
 	for _, optFn := range optsFn {
 		optFn(opts)
 	}
 
+	err := opts.validate()
+	if err != nil {
+		return nil, err
+	}
+	opts.keys = newKeyRing(opts.KeyProvider)
+
 	db := &Bitcask{
 		option:         opts,
 		openedSegments: make(map[string]*Segment),
-		keyDir:         NewKeyDir(),
+		keyDir:         newKeyDir(opts.Index),
+		pins:           make(map[uint64]struct{}),
+		stats:          make(map[string]*fileStats),
 	}
 
-	dirEntries, err := os.ReadDir(opts.DirName)
-	if os.IsNotExist(err) {
+	_, err = os.Stat(opts.DirName)
+	if os.IsNotExist(err) && !opts.ReadOnly {
 		err = os.Mkdir(opts.DirName, 0755)
 		if err != nil {
 			return nil, err
@@ -39,72 +77,274 @@ func New(optsFn ...OptFn) (*Bitcask, error) {
 		return nil, err
 	}
 
-	var nextSegmentID int
-	if len(dirEntries) > 0 {
-		err = warmupKeyDir(db, dirEntries)
+	lock, err := acquireLock(opts.DirName, opts.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	db.lock = lock
+
+	m, rebuilt, err := openManifest(opts.DirName, opts)
+	if err != nil {
+		lock.Release()
+		return nil, err
+	}
+	db.manifest = m
+
+	if !opts.ReadOnly {
+		err = removeLeftoverFiles(opts.DirName, m, opts)
 		if err != nil {
+			lock.Release()
 			return nil, err
 		}
+	}
+
+	err = warmupKeyDir(db)
+	if err != nil {
+		lock.Release()
+		return nil, err
+	}
 
-		lastSegment := dirEntries[len(dirEntries)-1]
-		nextSegmentID = extractID(lastSegment.Name())
+	if opts.ReadOnly {
+		return db, nil
 	}
 
-	activeSegment, err := NewSegment(opts.DirName, getSegmentFilename(nextSegmentID))
+	// records are only appended to files of the current format, a segment
+	// of an older one is sealed
+	activeSegmentName := getSegmentFilename(m.ActiveID)
+	if slices.Contains(m.DataFiles, activeSegmentName) {
+		format, err := readFileFormat(path.Join(opts.DirName, activeSegmentName))
+		if err != nil {
+			lock.Release()
+			return nil, err
+		}
+		if format != currentFileFormat {
+			activeSegmentName = getSegmentFilename(m.ActiveID + 1)
+		}
+	}
+
+	activeSegment, err := NewSegment(opts.DirName, activeSegmentName)
 	if err != nil {
+		lock.Release()
 		return nil, err
 	}
 	db.activeSegment = activeSegment
 
-	merger := NewMerger(opts.DirName, db.keyDir, opts.MergeOpt)
+	// the files written from now on may be of a newer format than the
+	// database had so far
+	if rebuilt || !slices.Contains(m.DataFiles, activeSegmentName) || m.FormatVersion < formatVersion {
+		m.addDataFile(activeSegmentName)
+		m.FormatVersion = formatVersion
+		err = m.save(opts.DirName)
+		if err != nil {
+			activeSegment.Close()
+			lock.Release()
+			return nil, err
+		}
+	}
+
+	err = db.loadFileStats()
+	if err != nil {
+		activeSegment.Close()
+		lock.Release()
+		return nil, err
+	}
+
+	merger := NewMerger(db, opts.MergeOpt)
 	db.merger = merger
-	go merger.Start()
+	merger.Start()
+
+	if opts.SyncPolicy == SyncInterval {
+		db.startSyncer(opts.SyncInterval)
+	}
 
 	return db, nil
 }
 
 func (b *Bitcask) Close() error {
-	b.merger.Stop()
+	if b.merger != nil {
+		b.merger.Stop()
+	}
+	b.stopSyncer()
 
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// iterators left open can't be used after Close anyway
+	b.pinsMu.Lock()
+	b.removeUnusedFiles(len(b.unusedFiles))
+	b.pinsMu.Unlock()
+
+	b.segmentsMu.Lock()
 	for _, segment := range b.openedSegments {
 		segment.Close()
 	}
+	b.openedSegments = make(map[string]*Segment)
+	b.segmentsMu.Unlock()
+
+	if b.activeSegment == nil { // read-only
+		return b.lock.Release()
+	}
 
-	return b.activeSegment.Close()
+	err := b.activeSegment.Close()
+	if err != nil {
+		b.lock.Release()
+		return err
+	}
+
+	return b.lock.Release()
 }
 
 func (b *Bitcask) Put(key, val []byte) error {
-	segmentOffset, err := b.activeSegment.GetOffset()
+	if b.option.ReadOnly {
+		return ErrReadOnly
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entry, err := b.write(key, val, 0)
 	if err != nil {
 		return err
 	}
 
-	ts := uint32(time.Now().UnixNano())
-	encodedData, err := encode(key, val, uint32ToBytes(ts))
+	b.setEntry(key, entry)
+
+	return nil
+}
+
+// PutIfNotExists stores key/val only if the key doesn't exist yet, otherwise
+// ErrKeyExists is returned.
+func (b *Bitcask) PutIfNotExists(key, val []byte) error {
+	if b.option.ReadOnly {
+		return ErrReadOnly
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, exist := b.keyDir.Get(key)
+	if exist {
+		return ErrKeyExists
+	}
+
+	entry, err := b.write(key, val, 0)
 	if err != nil {
 		return err
 	}
 
-	if segmentOffset+len(encodedData) > b.option.SegmentSize {
-		nextSegmentID := extractID(b.activeSegment.GetID()) + 1
-		b.activeSegment, err = NewSegment(b.option.DirName, getSegmentFilename(nextSegmentID))
-		if err != nil {
-			return err
-		}
-		segmentOffset = 0
+	b.setEntry(key, entry)
+
+	return nil
+}
+
+// CompareAndSwap stores newVal only if the current value of the key equals
+// oldVal, otherwise ErrValueMismatch is returned.
+func (b *Bitcask) CompareAndSwap(key, oldVal, newVal []byte) error {
+	if b.option.ReadOnly {
+		return ErrReadOnly
 	}
 
-	err = b.activeSegment.Write(segmentOffset, encodedData)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entry, exist := b.keyDir.Get(key)
+	if !exist {
+		return ErrKeyNotFound
+	}
+
+	val, err := b.get(key, entry)
 	if err != nil {
 		return err
 	}
 
-	b.keyDir.Set(key, &Entry{
-		FileID:    b.activeSegment.GetID(),
-		ValueSize: len(val),
-		ValuePos:  getValuePos(key, segmentOffset),
-		Timestamp: ts,
-	})
+	if !bytes.Equal(val, oldVal) {
+		return ErrValueMismatch
+	}
+
+	entry, err = b.write(key, newVal, 0)
+	if err != nil {
+		return err
+	}
+
+	b.setEntry(key, entry)
+
+	return nil
+}
+
+// GetWithVersion returns the value of the key together with its version,
+// which can be passed to DeleteIfVersion.
+func (b *Bitcask) GetWithVersion(key []byte) ([]byte, *Entry, error) {
+	entry, exist := b.keyDir.Get(key)
+	if !exist {
+		return nil, nil, ErrKeyNotFound
+	}
+
+	val, err := b.get(key, entry)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	version := *entry
+	return val, &version, nil
+}
+
+// DeleteIfVersion deletes the key only if it wasn't rewritten since version
+// was obtained from GetWithVersion, otherwise ErrVersionMismatch is returned.
+func (b *Bitcask) DeleteIfVersion(key []byte, version *Entry) error {
+	if b.option.ReadOnly {
+		return ErrReadOnly
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entry, exist := b.keyDir.Get(key)
+	if !exist {
+		return ErrKeyNotFound
+	}
+
+	if !sameEntry(entry, version) {
+		return ErrVersionMismatch
+	}
+
+	err := b.writeTombstone(key)
+	if err != nil {
+		return err
+	}
+
+	b.setEntry(key, nil)
+
+	return nil
+}
+
+// Sync flushes all writes made so far to stable storage.
+func (b *Bitcask) Sync() error {
+	if b.option.ReadOnly {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.activeSegment.Sync()
+}
+
+// PutWithTTL stores key/val like Put, but the key expires after ttl. An
+// expired key behaves as if it was deleted.
+func (b *Bitcask) PutWithTTL(key, val []byte, ttl time.Duration) error {
+	if b.option.ReadOnly {
+		return ErrReadOnly
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entry, err := b.write(key, val, time.Now().Add(ttl).UnixNano())
+	if err != nil {
+		return err
+	}
+
+	b.setEntry(key, entry)
 
 	return nil
 }
@@ -119,105 +359,523 @@ func (b *Bitcask) Get(key []byte) ([]byte, error) {
 }
 
 func (b *Bitcask) Delete(key []byte) error {
+	if b.option.ReadOnly {
+		return ErrReadOnly
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
 	_, exist := b.keyDir.Get(key)
 	if !exist {
 		return ErrKeyNotFound
 	}
 
-	err := b.Put(key, tombstoneValue)
+	err := b.writeTombstone(key)
 	if err != nil {
 		return err
 	}
 
-	b.keyDir.Delete(key)
+	b.setEntry(key, nil)
 
 	return nil
 }
 
+// Merge merges right away, regardless of MergeOption.Interval and Window, and
+// returns once it's done. The files to merge are selected as for background
+// merges. A merge already running is waited for first; canceling ctx stops
+// waiting, and aborts the merge until its result is published.
+func (b *Bitcask) Merge(ctx context.Context) error {
+	if b.option.ReadOnly {
+		return ErrReadOnly
+	}
+
+	return b.merger.merge(ctx, false)
+}
+
+// MergeAll is like Merge but merges every file, regardless of
+// MergeOption.GarbageRatio and MinFiles, and seals the active segment first
+// so that it's merged too. Once it succeeded, every record written before is
+// encrypted with the current key, so that keys that are no longer current
+// can be retired.
+func (b *Bitcask) MergeAll(ctx context.Context) error {
+	if b.option.ReadOnly {
+		return ErrReadOnly
+	}
+
+	return b.merger.merge(ctx, true)
+}
+
+// PauseMerge holds a running merge, and keeps new ones from making progress,
+// until ResumeMerge is called, e.g. while the load is high. Backup aborts a
+// paused merge rather than waiting for it; a background merge is retried
+// later, Merge returns ErrMergeAborted.
+func (b *Bitcask) PauseMerge() {
+	if b.merger != nil {
+		b.merger.Pause()
+	}
+}
+
+func (b *Bitcask) ResumeMerge() {
+	if b.merger != nil {
+		b.merger.Resume()
+	}
+}
+
+// MergeStatus returns the status of the background merges. It's empty for a
+// database opened read-only, which never merges.
+func (b *Bitcask) MergeStatus() MergeStatus {
+	if b.merger == nil {
+		return MergeStatus{}
+	}
+
+	return b.merger.Status()
+}
+
 func (b *Bitcask) ListKeys() [][]byte {
 	return b.keyDir.GetKeys()
 }
 
+// Fold calls fn for every key/value pair as they were when Fold was called.
+// Unlike ListKeys, it doesn't hold all the keys in memory at once.
 func (b *Bitcask) Fold(fn func(key, val []byte) error) error {
-	keyAndEntry := b.keyDir.GetKeyAndEntry()
+	return b.fold(b.Iterator(), fn)
+}
+
+// Scan calls fn for every key in [start, end) in ascending order. A nil start
+// or end leaves that side of the range open. It requires the BTreeIndex.
+func (b *Bitcask) Scan(start, end []byte, fn func(key, val []byte) error) error {
+	if _, ok := b.keyDir.(OrderedKeyDir); !ok {
+		return ErrIndexNotOrdered
+	}
 
-	for key, entry := range keyAndEntry {
-		val, err := b.get([]byte(key), entry)
+	return b.fold(b.newIterator(start, end, &IterOption{}), fn)
+}
+
+// ReverseScan is like Scan but calls fn in descending key order.
+func (b *Bitcask) ReverseScan(start, end []byte, fn func(key, val []byte) error) error {
+	if _, ok := b.keyDir.(OrderedKeyDir); !ok {
+		return ErrIndexNotOrdered
+	}
+
+	return b.fold(b.newIterator(start, end, &IterOption{Reverse: true}), fn)
+}
+
+// PrefixScan calls fn for every key starting with prefix in ascending order.
+// It requires the BTreeIndex.
+func (b *Bitcask) PrefixScan(prefix []byte, fn func(key, val []byte) error) error {
+	return b.Scan(prefix, prefixEnd(prefix), fn)
+}
+
+func (b *Bitcask) fold(it *Iterator, fn func(key, val []byte) error) error {
+	defer it.Close()
+
+	for it.Next() {
+		val, err := it.Value()
 		if err != nil {
 			return err
 		}
 
-		err = fn([]byte(key), val)
+		err = fn(it.Key(), val)
 		if err != nil {
 			return err
 		}
 	}
 
+	return it.Err()
+}
+
+// write appends key/val to the active segment, compressing val if a
+// compressor is configured. An expiry of 0 means the key never expires. The
+// caller must hold b.mu.
+func (b *Bitcask) write(key, val []byte, expiry int64) (*Entry, error) {
+	val, flags, err := b.option.compressValue(val)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.writeRecord(&DiskEntry{
+		Type:   recordPut,
+		Flags:  flags,
+		Expiry: expiry,
+		Key:    key,
+		Value:  val,
+	})
+}
+
+// writeTombstone appends a tombstone of key to the active segment. The
+// caller must hold b.mu.
+func (b *Bitcask) writeTombstone(key []byte) error {
+	_, err := b.writeRecord(&DiskEntry{
+		Type: recordDelete,
+		Key:  key,
+	})
+
+	return err
+}
+
+// writeRecord timestamps diskEntry, encrypts it if a key provider is
+// configured and appends it to the active segment. It returns the entry of
+// its key. The caller must hold b.mu.
+func (b *Bitcask) writeRecord(diskEntry *DiskEntry) (*Entry, error) {
+	key := diskEntry.Key
+	diskEntry.Ts = uint32(time.Now().UnixNano())
+
+	err := b.option.keys.seal(diskEntry)
+	if err != nil {
+		return nil, err
+	}
+
+	encodedData, err := encode(diskEntry)
+	if err != nil {
+		return nil, err
+	}
+
+	segmentOffset, err := b.append(encodedData)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Entry{
+		FileID:    b.activeSegment.GetID(),
+		ValueSize: len(diskEntry.Value),
+		ValuePos:  getValuePos(key, segmentOffset),
+		Timestamp: diskEntry.Ts,
+		Expiry:    diskEntry.Expiry,
+		seq:       nextSeq(),
+	}, nil
+}
+
+// append writes data to the active segment as a whole, rotating to a new
+// segment first when the current one is full, and returns the offset it was
+// written at. The caller must hold b.mu.
+func (b *Bitcask) append(data []byte) (int, error) {
+	segmentOffset, err := b.activeSegment.GetOffset()
+	if err != nil {
+		return 0, err
+	}
+
+	if segmentOffset > b.activeSegment.DataOffset() && segmentOffset+len(data) > b.option.SegmentSize {
+		err = b.rotate()
+		if err != nil {
+			return 0, err
+		}
+		segmentOffset = b.activeSegment.DataOffset()
+	}
+
+	err = b.activeSegment.Write(segmentOffset, data)
+	if err != nil {
+		return 0, err
+	}
+	b.fileStats(b.activeSegment.GetID()).size += int64(len(data))
+
+	if b.option.SyncPolicy == SyncAlways {
+		err = b.activeSegment.Sync()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return segmentOffset, nil
+}
+
+// rotate seals the active segment and makes a new, empty one active. The
+// caller must hold b.mu.
+func (b *Bitcask) rotate() error {
+	nextSegmentName := getSegmentFilename(extractID(b.activeSegment.GetID()) + 1)
+	nextSegment, err := NewSegment(b.option.DirName, nextSegmentName)
+	if err != nil {
+		return err
+	}
+
+	// the new segment only becomes part of the database once it's in the
+	// manifest
+	m := b.manifest.clone()
+	m.addDataFile(nextSegmentName)
+	err = m.save(b.option.DirName)
+	if err != nil {
+		nextSegment.Close()
+		return err
+	}
+	b.manifest = m
+
+	err = b.activeSegment.Close()
+	if err != nil {
+		nextSegment.Close()
+		return err
+	}
+
+	b.activeSegment = nextSegment
+
+	// the header isn't garbage, merging doesn't reclaim it
+	stats := b.fileStats(nextSegmentName)
+	stats.size += int64(nextSegment.DataOffset())
+	stats.live += int64(nextSegment.DataOffset())
+
 	return nil
 }
 
+func (b *Bitcask) startSyncer(interval time.Duration) {
+	b.syncStopCh = make(chan struct{})
+	b.syncWg.Add(1)
+
+	go func() {
+		defer b.syncWg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				// a failed sync leaves the data for the next tick to flush
+				_ = b.Sync()
+			case <-b.syncStopCh:
+				return
+			}
+		}
+	}()
+}
+
+func (b *Bitcask) stopSyncer() {
+	if b.syncStopCh == nil {
+		return
+	}
+
+	close(b.syncStopCh)
+	b.syncWg.Wait()
+	b.syncStopCh = nil
+}
+
 func (b *Bitcask) get(key []byte, entry *Entry) ([]byte, error) {
-	var err error
+	for {
+		segment, err := b.openSegment(entry.FileID)
+		if err == nil {
+			val, err := b.readValue(segment, key, entry)
+			if !errors.Is(err, os.ErrClosed) {
+				return val, err
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, ErrOpenSegmentFailed
+		}
 
-	segment, ok := b.openedSegments[entry.FileID]
-	if !ok {
-		segment, err = OpenSegment(b.option.DirName, entry.FileID)
-		if err != nil {
+		// the segment was removed by the merger after we looked the key up,
+		// so the key dir must already point somewhere else by now.
+		latest, exist := b.keyDir.Get(key)
+		if !exist {
+			return nil, ErrKeyNotFound
+		}
+		if latest.FileID == entry.FileID {
 			return nil, ErrOpenSegmentFailed
 		}
+		entry = latest
+	}
+}
 
-		b.openedSegments[entry.FileID] = segment
+// read reads the value of key from entry, which must be in a pinned file.
+func (b *Bitcask) read(key []byte, entry *Entry) ([]byte, error) {
+	segment, err := b.openSegment(entry.FileID)
+	if err != nil {
+		return nil, ErrOpenSegmentFailed
 	}
 
-	return segment.Read(entry.ValuePos, entry.ValueSize)
+	return b.readValue(segment, key, entry)
 }
 
-func warmupKeyDir(db *Bitcask, dirEntries []fs.DirEntry) error {
-	filesName := make([]string, 0, len(dirEntries))
-	fileNameMap := make(map[string]bool)
+// readValue reads the record of key that entry points at from segment,
+// checks and decrypts it and returns its value, decompressed.
+func (b *Bitcask) readValue(segment *Segment, key []byte, entry *Entry) ([]byte, error) {
+	headerLen := segment.format.headerLen()
+	offset := entry.ValuePos - len(key) - headerLen
+	data, err := segment.Read(offset, headerLen+len(key)+entry.ValueSize)
+	if err != nil {
+		return nil, err
+	}
+
+	diskEntry, _, err := segment.format.decodeRecord(data)
+	if err == nil {
+		err = b.option.keys.open(diskEntry)
+	}
+	if err != nil {
+		return nil, &CorruptionError{FileID: entry.FileID, Offset: offset, Err: err}
+	}
+
+	return b.option.decodeValue(diskEntry)
+}
 
-	for _, dirEntry := range dirEntries {
-		filesName = append(filesName, dirEntry.Name())
-		fileNameMap[dirEntry.Name()] = true
+func (b *Bitcask) openSegment(fileID string) (*Segment, error) {
+	b.segmentsMu.RLock()
+	segment, ok := b.openedSegments[fileID]
+	b.segmentsMu.RUnlock()
+	if ok {
+		return segment, nil
 	}
 
-	dataFilesName := make([]string, 0)
+	b.segmentsMu.Lock()
+	defer b.segmentsMu.Unlock()
+
+	segment, ok = b.openedSegments[fileID]
+	if ok {
+		return segment, nil
+	}
+
+	segment, err := OpenSegment(b.option.DirName, fileID)
+	if err != nil {
+		return nil, err
+	}
+	b.openedSegments[fileID] = segment
+
+	return segment, nil
+}
+
+// removeFile removes a file the key dir no longer refers to and closes its
+// segment, if opened. The file is removed first, so that it can't be opened
+// again; reads through the closed segment fail with os.ErrClosed.
+func (b *Bitcask) removeFile(fileName string) error {
+	err := os.RemoveAll(path.Join(b.option.DirName, fileName))
+	if err != nil {
+		return err
+	}
+
+	b.segmentsMu.Lock()
+	defer b.segmentsMu.Unlock()
+
+	segment, ok := b.openedSegments[fileName]
+	if !ok {
+		return nil
+	}
+	delete(b.openedSegments, fileName)
+
+	return segment.f.Close()
+}
+
+// unusedFile is a file the key dir no longer refers to, but the pins taken
+// up to seq may still read from.
+type unusedFile struct {
+	name string
+	seq  uint64
+}
+
+// pinFiles keeps the files the key dir refers to from being removed until
+// unpinFiles is called. The pin must be taken before the key dir is looked
+// at, so that a merge finishing in between can't remove its files.
+func (b *Bitcask) pinFiles() uint64 {
+	b.pinsMu.Lock()
+	defer b.pinsMu.Unlock()
+
+	b.pinSeq++
+	b.pins[b.pinSeq] = struct{}{}
+
+	return b.pinSeq
+}
+
+func (b *Bitcask) unpinFiles(pin uint64) {
+	b.pinsMu.Lock()
+	defer b.pinsMu.Unlock()
+
+	delete(b.pins, pin)
+
+	oldestPin := b.pinSeq + 1
+	for pin := range b.pins {
+		if pin < oldestPin {
+			oldestPin = pin
+		}
+	}
+
+	// unusedFiles is sorted by seq, remove the files no remaining pin needs
+	n := sort.Search(len(b.unusedFiles), func(i int) bool {
+		return b.unusedFiles[i].seq >= oldestPin
+	})
+	b.removeUnusedFiles(n)
+}
+
+// removeFiles removes files the key dir no longer refers to. If files are
+// pinned, that's deferred until the pins are released.
+func (b *Bitcask) removeFiles(filesName []string) error {
+	b.pinsMu.Lock()
+	defer b.pinsMu.Unlock()
+
+	if len(b.pins) > 0 {
+		for _, fileName := range filesName {
+			b.unusedFiles = append(b.unusedFiles, unusedFile{name: fileName, seq: b.pinSeq})
+		}
+		return nil
+	}
 
 	for _, fileName := range filesName {
-		fileExt := path.Ext(fileName)
+		err := b.removeFile(fileName)
+		if err != nil {
+			return err
+		}
+	}
 
-		switch fileExt {
-		case ".hint": // warm up key dir from hint files
-			hint, err := OpenHint(db.option.DirName, fileName)
-			if err != nil {
-				return err
-			}
-			defer hint.Close()
+	return nil
+}
 
-			keyDir, err := hint.Read()
+// removeUnusedFiles removes the first n unused files. The caller must hold
+// b.pinsMu.
+func (b *Bitcask) removeUnusedFiles(n int) {
+	for _, file := range b.unusedFiles[:n] {
+		err := b.removeFile(file.name)
+		if err != nil {
+			b.option.Logger.Printf("gobitcask: failed to remove unused file %v: %v", file.name, err)
+		}
+	}
+
+	b.unusedFiles = append(b.unusedFiles[:0], b.unusedFiles[n:]...)
+}
+
+// warmupKeyDir loads the files of the manifest into the key dir, oldest
+// first. A merge file is named after the newest file it copied records from,
+// so hint files are loaded in ID order along with the data files, before the
+// data file of the same ID, which only holds newer records.
+func warmupKeyDir(db *Bitcask) error {
+	now := time.Now().UnixNano()
+	hintFiles, dataFiles := db.manifest.HintFiles, db.manifest.DataFiles
+
+	for len(hintFiles) > 0 || len(dataFiles) > 0 {
+		if len(hintFiles) > 0 && (len(dataFiles) == 0 || extractID(hintFiles[0]) <= extractID(dataFiles[0])) {
+			err := warmUpHintFile(db.keyDir, db.option.DirName, hintFiles[0], db.option.keys)
 			if err != nil {
 				return err
 			}
 
-			db.keyDir.Merge(keyDir)
-		case ".data":
-			dataFilesName = append(dataFilesName, fileName)
-		default:
+			hintFiles = hintFiles[1:]
 			continue
 		}
+
+		err := warmUpDataFile(db.keyDir, db.option.DirName, dataFiles[0], len(dataFiles) == 1, now, db.option)
+		if err != nil {
+			return err
+		}
+
+		dataFiles = dataFiles[1:]
 	}
 
-	// warm up key dir from data files
-	err := db.keyDir.WarmUp(db.option.DirName, dataFilesName)
+	return nil
+}
+
+func warmUpHintFile(keyDir KeyDir, dirName, fileName string, keys *keyRing) error {
+	hint, err := OpenHint(dirName, fileName)
 	if err != nil {
 		return err
 	}
+	defer hint.Close()
+	hint.keys = keys
 
-	return nil
+	return hint.forEach(func(key []byte, entry *Entry, tombstone bool) bool {
+		if tombstone {
+			keyDir.Delete(key)
+			return true
+		}
+
+		keyDir.Set(key, entry)
+		return true
+	})
 }
 
-func encode(key, val, ts []byte) ([]byte, error) {
-	rawData, err := encodeRawData(key, val, ts)
+func encode(diskEntry *DiskEntry) ([]byte, error) {
+	rawData, err := encodeRawData(diskEntry)
 	if err != nil {
 		return nil, err
 	}
@@ -242,35 +900,53 @@ func encode(key, val, ts []byte) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func encodeRawData(key, val, ts []byte) ([]byte, error) {
+func encodeRawData(diskEntry *DiskEntry) ([]byte, error) {
 	buf := bytes.NewBuffer(nil)
 
+	// write record type
+	err := buf.WriteByte(byte(diskEntry.Type))
+	if err != nil {
+		return nil, err
+	}
+
+	// write flags
+	err = buf.WriteByte(diskEntry.Flags)
+	if err != nil {
+		return nil, err
+	}
+
 	// write timestamp
-	_, err := buf.Write(ts)
+	_, err = buf.Write(uint32ToBytes(diskEntry.Ts))
+	if err != nil {
+		return nil, err
+	}
+
+	// write expiry
+	_, err = buf.Write(uint64ToBytes(uint64(diskEntry.Expiry)))
 	if err != nil {
 		return nil, err
 	}
 
 	// write key size
-	_, err = buf.Write(uint32ToBytes(uint32(len(key))))
+	_, err = buf.Write(uint32ToBytes(uint32(len(diskEntry.Key))))
 	if err != nil {
 		return nil, err
 	}
 
 	// write value size
-	_, err = buf.Write(uint64ToBytes(uint64(len(val))))
+	_, err = buf.Write(uint64ToBytes(uint64(len(diskEntry.Value))))
 	if err != nil {
 		return nil, err
 	}
 
 	// write key
-	_, err = buf.Write(key)
+	_, err = buf.Write(diskEntry.Key)
 	if err != nil {
 		return nil, err
 	}
 
 	// write value
-	_, err = buf.Write(val)
+	_, err = buf.Write(diskEntry.Value)
 	if err != nil {
 		return nil, err
 	}
@@ -278,35 +954,58 @@ func encodeRawData(key, val, ts []byte) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func decode(data []byte) (checksum, ts uint32, key, value []byte) {
-	buf := bytes.NewBuffer(data)
-
-	// get checksum
-	checksum = bytesToUint32(buf.Next(checksumLen))
-
-	// get ts
-	ts = bytesToUint32(buf.Next(tsLen))
+// decodeRecord decodes the record at the beginning of data and returns it
+// together with its encoded length. The length is also returned for
+// ErrChecksumNotMatch so that the caller can skip the record.
+func decodeRecord(data []byte) (*DiskEntry, int, error) {
+	if len(data) < headerLen {
+		return nil, 0, ErrIncompleteRecord
+	}
 
-	// get key size
-	keySize := bytesToUint32(buf.Next(keySizeLen))
+	checksum := bytesToUint32(data)
+	typ := recordType(data[checksumLen])
+	flags := data[checksumLen+typeLen]
+	ts := bytesToUint32(data[checksumLen+typeLen+flagsLen:])
+	expiry := int64(bytesToUint64(data[checksumLen+typeLen+flagsLen+tsLen:]))
+	keySize := uint64(bytesToUint32(data[checksumLen+typeLen+flagsLen+tsLen+expiryLen:]))
+	valueSize := bytesToUint64(data[checksumLen+typeLen+flagsLen+tsLen+expiryLen+keySizeLen:])
+
+	remaining := uint64(len(data) - headerLen)
+	if keySize > remaining || valueSize > remaining-keySize {
+		return nil, 0, ErrIncompleteRecord
+	}
 
-	// get value size
-	valueSize := bytesToUint64(buf.Next(valueSizeLen))
+	n := headerLen + int(keySize) + int(valueSize)
+	if checksum != crc32.ChecksumIEEE(data[checksumLen:n]) {
+		return nil, n, ErrChecksumNotMatch
+	}
 
-	// get key
-	key = buf.Next(int(keySize))
+	return &DiskEntry{
+		Checksum: checksum,
+		Type:     typ,
+		Flags:    flags,
+		Ts:       ts,
+		Expiry:   expiry,
+		Key:      data[headerLen : headerLen+int(keySize)],
+		Value:    data[headerLen+int(keySize) : n],
+	}, n, nil
+}
 
-	// get value
-	value = buf.Next(int(valueSize))
+// nextRecord returns the offset in data, which starts with a corrupted
+// record, of the first valid record that follows it, or len(data) if there is
+// none. The size fields of the corrupted record may be damaged too, so every
+// offset is tried rather than only the end of the record.
+func nextRecord(format fileFormat, data []byte) int {
+	for offset := 1; offset < len(data); offset++ {
+		_, _, err := format.decodeRecord(data[offset:])
+		if err == nil {
+			return offset
+		}
+	}
 
-	return
+	return len(data)
 }
 
 func getValuePos(key []byte, segmentOffset int) int {
-	return int(segmentOffset) +
-		checksumLen +
-		tsLen +
-		keySizeLen +
-		valueSizeLen +
-		len(key)
+	return int(segmentOffset) + headerLen + len(key)
 }
@@ -1,8 +1,14 @@
 package gobitcask
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"log"
 	"os"
+	"path"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
@@ -21,6 +27,162 @@ func TestCreateNewBitcask(t *testing.T) {
 	)
 	assert.Nil(t, err)
 	assert.NotNil(t, bc)
+	defer bc.Close()
+}
+
+func TestDirectoryLock(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	bc, err := New(
+		WithDirName(dirName),
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+
+	bc2, err := New(
+		WithDirName(dirName),
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	)
+	assert.Equal(t, ErrDatabaseLocked, err)
+	assert.Nil(t, bc2)
+
+	err = bc.Close()
+	assert.Nil(t, err)
+
+	bc2, err = New(
+		WithDirName(dirName),
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc2)
+	defer bc2.Close()
+}
+
+func TestReadOnlyKeepsWritersOut(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	opts := []OptFn{
+		WithDirName(dirName),
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	}
+
+	bc, err := New(opts...)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+
+	err = bc.Put([]byte("key1"), []byte("val1"))
+	assert.Nil(t, err)
+
+	err = bc.Close()
+	assert.Nil(t, err)
+
+	dirEntries, err := os.ReadDir(dirName)
+	assert.Nil(t, err)
+
+	ro, err := New(WithDirName(dirName), WithReadOnly())
+	assert.Nil(t, err)
+	assert.NotNil(t, ro)
+
+	// the reader locks the directory without creating any file in it
+	_, err = New(opts...)
+	assert.Equal(t, ErrDatabaseLocked, err)
+
+	newDirEntries, err := os.ReadDir(dirName)
+	assert.Nil(t, err)
+	assert.Equal(t, len(dirEntries), len(newDirEntries))
+
+	err = ro.Close()
+	assert.Nil(t, err)
+
+	bc, err = New(opts...)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+
+	// and the other way around
+	_, err = New(WithDirName(dirName), WithReadOnly())
+	assert.Equal(t, ErrDatabaseLocked, err)
+
+	err = bc.Close()
+	assert.Nil(t, err)
+}
+
+func TestReadOnly(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	_, err := New(WithDirName(dirName), WithReadOnly())
+	assert.True(t, os.IsNotExist(err))
+
+	bc, err := New(
+		WithDirName(dirName),
+		WithSegmentSize(128), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+
+	for i := 0; i < 10; i++ {
+		key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i)
+		err = bc.Put([]byte(key), []byte(val))
+		assert.Nil(t, err)
+	}
+
+	err = bc.Close()
+	assert.Nil(t, err)
+
+	dirEntries, err := os.ReadDir(dirName)
+	assert.Nil(t, err)
+
+	// several readers may share the directory
+	ro1, err := New(WithDirName(dirName), WithReadOnly())
+	assert.Nil(t, err)
+	assert.NotNil(t, ro1)
+	defer ro1.Close()
+
+	ro2, err := New(WithDirName(dirName), WithReadOnly())
+	assert.Nil(t, err)
+	assert.NotNil(t, ro2)
+	defer ro2.Close()
+
+	// but not with a writer
+	_, err = New(
+		WithDirName(dirName),
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	)
+	assert.Equal(t, ErrDatabaseLocked, err)
+
+	for i := 0; i < 10; i++ {
+		key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i)
+		fetchedVal, err := ro1.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.EqualValues(t, val, fetchedVal)
+	}
+	assert.Equal(t, 10, len(ro2.ListKeys()))
+
+	err = ro1.Put([]byte("key0"), []byte("newval"))
+	assert.Equal(t, ErrReadOnly, err)
+
+	err = ro1.Delete([]byte("key0"))
+	assert.Equal(t, ErrReadOnly, err)
+
+	newDirEntries, err := os.ReadDir(dirName)
+	assert.Nil(t, err)
+	assert.Equal(t, len(dirEntries), len(newDirEntries))
 }
 
 func TestEncode(t *testing.T) {
@@ -28,15 +190,27 @@ func TestEncode(t *testing.T) {
 	val := []byte("val1")
 	ts := uint32(time.Now().UnixNano())
 
-	encodedData, err := encode(key, val, uint32ToBytes(ts))
+	expiry := time.Now().Add(time.Minute).UnixNano()
+
+	encodedData, err := encode(&DiskEntry{
+		Type:   recordPut,
+		Ts:     ts,
+		Expiry: expiry,
+		Key:    key,
+		Value:  val,
+	})
 	assert.Nil(t, err)
 	assert.NotZero(t, len(encodedData))
 
-	checksum, decodedTs, decodedKey, decodedVal := decode(encodedData)
-	assert.EqualValues(t, key, decodedKey)
-	assert.EqualValues(t, val, decodedVal)
-	assert.EqualValues(t, ts, decodedTs)
-	assert.NotZero(t, checksum)
+	diskEntry, n, err := decodeRecord(encodedData)
+	assert.Nil(t, err)
+	assert.Equal(t, len(encodedData), n)
+	assert.Equal(t, recordPut, diskEntry.Type)
+	assert.EqualValues(t, key, diskEntry.Key)
+	assert.EqualValues(t, val, diskEntry.Value)
+	assert.EqualValues(t, ts, diskEntry.Ts)
+	assert.EqualValues(t, expiry, diskEntry.Expiry)
+	assert.NotZero(t, diskEntry.Checksum)
 }
 
 func TestSimplePutGet(t *testing.T) {
@@ -52,6 +226,7 @@ func TestSimplePutGet(t *testing.T) {
 	)
 	assert.Nil(t, err)
 	assert.NotNil(t, bc)
+	defer bc.Close()
 
 	key := []byte("key1")
 	val := []byte("val1")
@@ -77,6 +252,7 @@ func TestSimplePutDelete(t *testing.T) {
 	)
 	assert.Nil(t, err)
 	assert.NotNil(t, bc)
+	defer bc.Close()
 
 	key := []byte("key1")
 	val := []byte("val1")
@@ -92,6 +268,173 @@ func TestSimplePutDelete(t *testing.T) {
 	assert.Equal(t, ErrKeyNotFound, err)
 }
 
+func TestPutIfNotExists(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	bc, err := New(
+		WithDirName(dirName),
+		WithSegmentSize(128), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+	defer bc.Close()
+
+	err = bc.PutIfNotExists([]byte("key1"), []byte("val1"))
+	assert.Nil(t, err)
+
+	err = bc.PutIfNotExists([]byte("key1"), []byte("val2"))
+	assert.Equal(t, ErrKeyExists, err)
+
+	fetchedVal, err := bc.Get([]byte("key1"))
+	assert.Nil(t, err)
+	assert.EqualValues(t, "val1", fetchedVal)
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	bc, err := New(
+		WithDirName(dirName),
+		WithSegmentSize(128), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 10 * time.Millisecond,
+		}),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+	defer bc.Close()
+
+	err = bc.CompareAndSwap([]byte("counter"), []byte("0"), []byte("1"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	err = bc.Put([]byte("counter"), []byte("0"))
+	assert.Nil(t, err)
+
+	err = bc.CompareAndSwap([]byte("counter"), []byte("1"), []byte("2"))
+	assert.Equal(t, ErrValueMismatch, err)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < 50; i++ {
+				for {
+					val, err := bc.Get([]byte("counter"))
+					assert.Nil(t, err)
+
+					counter, err := strconv.Atoi(string(val))
+					assert.Nil(t, err)
+
+					err = bc.CompareAndSwap([]byte("counter"), val, []byte(strconv.Itoa(counter+1)))
+					if err != ErrValueMismatch {
+						assert.Nil(t, err)
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	fetchedVal, err := bc.Get([]byte("counter"))
+	assert.Nil(t, err)
+	assert.EqualValues(t, "400", fetchedVal)
+}
+
+func TestDeleteIfVersion(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	bc, err := New(
+		WithDirName(dirName),
+		WithSegmentSize(128), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+	defer bc.Close()
+
+	err = bc.Put([]byte("key1"), []byte("val1"))
+	assert.Nil(t, err)
+
+	fetchedVal, version, err := bc.GetWithVersion([]byte("key1"))
+	assert.Nil(t, err)
+	assert.EqualValues(t, "val1", fetchedVal)
+
+	err = bc.Put([]byte("key1"), []byte("val2"))
+	assert.Nil(t, err)
+
+	err = bc.DeleteIfVersion([]byte("key1"), version)
+	assert.Equal(t, ErrVersionMismatch, err)
+
+	_, version, err = bc.GetWithVersion([]byte("key1"))
+	assert.Nil(t, err)
+
+	err = bc.DeleteIfVersion([]byte("key1"), version)
+	assert.Nil(t, err)
+
+	_, err = bc.Get([]byte("key1"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	err = bc.DeleteIfVersion([]byte("key1"), version)
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestDeleteIfVersionAfterMerge(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	bc, err := New(
+		WithDirName(dirName),
+		WithSegmentSize(128), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+	defer bc.Close()
+
+	err = bc.Put([]byte("key1"), []byte("val1"))
+	assert.Nil(t, err)
+	err = bc.Put([]byte("key2"), []byte("val2"))
+	assert.Nil(t, err)
+
+	_, version1, err := bc.GetWithVersion([]byte("key1"))
+	assert.Nil(t, err)
+	_, version2, err := bc.GetWithVersion([]byte("key2"))
+	assert.Nil(t, err)
+
+	err = bc.Put([]byte("key2"), []byte("val3"))
+	assert.Nil(t, err)
+
+	// rotate, so that both keys get merged
+	err = bc.Put([]byte("filler"), make([]byte, 100))
+	assert.Nil(t, err)
+
+	err = bc.Merge(context.Background())
+	assert.Nil(t, err)
+
+	entry, _ := bc.keyDir.Get([]byte("key1"))
+	assert.NotEqual(t, version1.FileID, entry.FileID)
+
+	// the merge moved key1, but didn't rewrite it
+	err = bc.DeleteIfVersion([]byte("key1"), version1)
+	assert.Nil(t, err)
+
+	err = bc.DeleteIfVersion([]byte("key2"), version2)
+	assert.Equal(t, ErrVersionMismatch, err)
+}
+
 func TestListKeys(t *testing.T) {
 	dirName := "./test"
 	defer os.RemoveAll(dirName)
@@ -105,6 +448,7 @@ func TestListKeys(t *testing.T) {
 	)
 	assert.Nil(t, err)
 	assert.NotNil(t, bc)
+	defer bc.Close()
 
 	key1, val1 := []byte("key1"), []byte("val1")
 	err = bc.Put(key1, val1)
@@ -130,7 +474,7 @@ func TestListKeys(t *testing.T) {
 
 func TestKeyDirWarmUp(t *testing.T) {
 	dirName := "./test"
-	// defer os.RemoveAll(dirName)
+	defer os.RemoveAll(dirName)
 
 	bc, err := New(
 		WithDirName(dirName),
@@ -160,10 +504,11 @@ func TestKeyDirWarmUp(t *testing.T) {
 	)
 	assert.Nil(t, err)
 	assert.NotNil(t, bc2)
+	defer bc2.Close()
 
 	for i := 0; i < 2; i++ {
 		key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i)
-		fetchedVal, err := bc.Get([]byte(key))
+		fetchedVal, err := bc2.Get([]byte(key))
 		assert.Nil(t, err)
 		assert.EqualValues(t, val, fetchedVal)
 	}
@@ -189,10 +534,11 @@ func TestKeyDirWarmUpWithHintFiles(t *testing.T) {
 		assert.Nil(t, err)
 	}
 
-	m := NewMerger(dirName, bc.keyDir, &MergeOption{Interval: 50 * time.Millisecond})
-	go m.Start()
+	m := NewMerger(bc, &MergeOption{Interval: 50 * time.Millisecond})
+	m.Start()
 
 	<-time.After(500 * time.Millisecond)
+	m.Stop()
 	bc.Close()
 
 	bc2, err := New(
@@ -204,10 +550,11 @@ func TestKeyDirWarmUpWithHintFiles(t *testing.T) {
 	)
 	assert.Nil(t, err)
 	assert.NotNil(t, bc2)
+	defer bc2.Close()
 
 	for i := 0; i < 100; i++ {
 		key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i)
-		fetchedVal, err := bc.Get([]byte(key))
+		fetchedVal, err := bc2.Get([]byte(key))
 		assert.Nil(t, err)
 		assert.EqualValues(t, val, fetchedVal)
 	}
@@ -226,6 +573,7 @@ func TestFold(t *testing.T) {
 	)
 	assert.Nil(t, err)
 	assert.NotNil(t, bc)
+	defer bc.Close()
 
 	m := make(map[string]string, 100)
 	for i := 0; i < 100; i++ {
@@ -244,3 +592,778 @@ func TestFold(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Zero(t, len(m))
 }
+
+func TestConcurrentPutGet(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	bc, err := New(
+		WithDirName(dirName),
+		WithSegmentSize(1024), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+	defer bc.Close()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			for i := 0; i < 200; i++ {
+				key, val := fmt.Sprintf("key%v-%v", w, i), fmt.Sprintf("val%v-%v", w, i)
+				err := bc.Put([]byte(key), []byte(val))
+				assert.Nil(t, err)
+
+				fetchedVal, err := bc.Get([]byte(key))
+				assert.Nil(t, err)
+				assert.EqualValues(t, val, fetchedVal)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 8*200, len(bc.ListKeys()))
+}
+
+func TestConcurrentPutDeleteFoldWithMerge(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	bc, err := New(
+		WithDirName(dirName),
+		WithSegmentSize(256), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 10 * time.Millisecond,
+		}),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+	defer bc.Close()
+
+	stopCh := make(chan struct{})
+	var wg sync.WaitGroup
+
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			for i := 0; i < 300; i++ {
+				key, val := fmt.Sprintf("key%v", i%50), fmt.Sprintf("val%v-%v", w, i)
+				err := bc.Put([]byte(key), []byte(val))
+				assert.Nil(t, err)
+
+				if i%3 == 0 {
+					err = bc.Delete([]byte(key))
+					if err != ErrKeyNotFound {
+						assert.Nil(t, err)
+					}
+				}
+			}
+		}(w)
+	}
+
+	var readers sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+
+			for {
+				select {
+				case <-stopCh:
+					return
+				default:
+				}
+
+				for i := 0; i < 50; i++ {
+					_, err := bc.Get([]byte(fmt.Sprintf("key%v", i)))
+					if err != ErrKeyNotFound {
+						assert.Nil(t, err)
+					}
+				}
+
+				err := bc.Fold(func(key, val []byte) error {
+					assert.NotEmpty(t, val)
+					return nil
+				})
+				assert.Nil(t, err)
+
+				bc.ListKeys()
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(stopCh)
+	readers.Wait()
+}
+
+// crash simulates a process crash: background work stops, file handles are
+// dropped without being synced and the active segment is cut off at synced,
+// the offset up to which the test knows its data to be on disk.
+func crash(t *testing.T, bc *Bitcask, synced int) {
+	if bc.merger != nil {
+		bc.merger.Stop()
+	}
+	bc.stopSyncer()
+
+	for _, segment := range bc.openedSegments {
+		segment.f.Close()
+	}
+
+	activeSegment := bc.activeSegment
+	activeSegment.f.Close()
+
+	filePath := path.Join(bc.option.DirName, activeSegment.GetID())
+	err := os.Truncate(filePath, int64(synced))
+	assert.Nil(t, err)
+
+	err = bc.lock.Release()
+	assert.Nil(t, err)
+}
+
+func TestSyncPolicy(t *testing.T) {
+	testCases := []struct {
+		name        string
+		opts        []OptFn
+		wait        time.Duration
+		synced      bool // whether the writes are on disk when the process crashes
+		expectedLen int
+	}{
+		{
+			name:        "never",
+			opts:        []OptFn{WithSyncPolicy(SyncNever)},
+			expectedLen: 0,
+		},
+		{
+			name:        "always",
+			opts:        []OptFn{WithSyncPolicy(SyncAlways)},
+			synced:      true,
+			expectedLen: 10,
+		},
+		{
+			name:        "interval",
+			opts:        []OptFn{WithSyncInterval(10 * time.Millisecond)},
+			wait:        100 * time.Millisecond,
+			synced:      true,
+			expectedLen: 10,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dirName := "./test"
+			defer os.RemoveAll(dirName)
+
+			opts := append([]OptFn{
+				WithDirName(dirName),
+				WithSegmentSize(1024), // bytes
+				WithMergeOpt(&MergeOption{
+					Interval: 6 * time.Hour,
+				}),
+			}, tc.opts...)
+
+			bc, err := New(opts...)
+			assert.Nil(t, err)
+			assert.NotNil(t, bc)
+
+			synced, err := bc.activeSegment.GetOffset()
+			assert.Nil(t, err)
+
+			for i := 0; i < 10; i++ {
+				key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i)
+				err = bc.Put([]byte(key), []byte(val))
+				assert.Nil(t, err)
+			}
+
+			<-time.After(tc.wait)
+			if tc.synced {
+				synced, err = bc.activeSegment.GetOffset()
+				assert.Nil(t, err)
+			}
+			crash(t, bc, synced)
+
+			bc2, err := New(opts...)
+			assert.Nil(t, err)
+			assert.NotNil(t, bc2)
+			defer bc2.Close()
+
+			assert.Equal(t, tc.expectedLen, len(bc2.ListKeys()))
+		})
+	}
+}
+
+func TestExplicitSync(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	bc, err := New(
+		WithDirName(dirName),
+		WithSegmentSize(1024), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+
+	err = bc.Put([]byte("key1"), []byte("val1"))
+	assert.Nil(t, err)
+
+	err = bc.Sync()
+	assert.Nil(t, err)
+
+	synced, err := bc.activeSegment.GetOffset()
+	assert.Nil(t, err)
+
+	err = bc.Put([]byte("key2"), []byte("val2"))
+	assert.Nil(t, err)
+
+	crash(t, bc, synced)
+
+	bc2, err := New(
+		WithDirName(dirName),
+		WithSegmentSize(1024), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc2)
+	defer bc2.Close()
+
+	fetchedVal, err := bc2.Get([]byte("key1"))
+	assert.Nil(t, err)
+	assert.EqualValues(t, "val1", fetchedVal)
+
+	_, err = bc2.Get([]byte("key2"))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestInvalidSyncInterval(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	for _, opt := range []OptFn{WithSyncPolicy(SyncInterval), WithSyncInterval(-time.Second)} {
+		_, err := New(
+			WithDirName(dirName),
+			WithMergeOpt(&MergeOption{
+				Interval: 6 * time.Hour,
+			}),
+			opt,
+		)
+		assert.ErrorIs(t, err, ErrInvalidOption)
+	}
+}
+
+func TestRecoverTornTail(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	opts := []OptFn{
+		WithDirName(dirName),
+		WithSegmentSize(128), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	}
+
+	bc, err := New(opts...)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+
+	for i := 0; i < 10; i++ {
+		key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i)
+		err = bc.Put([]byte(key), []byte(val))
+		assert.Nil(t, err)
+	}
+
+	lastSegmentPath := path.Join(dirName, bc.activeSegment.GetID())
+	err = bc.Close()
+	assert.Nil(t, err)
+
+	info, err := os.Stat(lastSegmentPath)
+	assert.Nil(t, err)
+
+	// simulate a crash in the middle of writing a record
+	encodedData, err := encode(&DiskEntry{
+		Type:  recordPut,
+		Key:   []byte("key10"),
+		Value: []byte("val10"),
+	})
+	assert.Nil(t, err)
+
+	f, err := os.OpenFile(lastSegmentPath, os.O_APPEND|os.O_WRONLY, 0755)
+	assert.Nil(t, err)
+	_, err = f.Write(encodedData[:len(encodedData)/2])
+	assert.Nil(t, err)
+	f.Close()
+
+	_, err = New(append(opts, WithRecoveryMode(RecoveryStrict))...)
+	var corruptionErr *CorruptionError
+	assert.ErrorAs(t, err, &corruptionErr)
+	assert.ErrorIs(t, err, ErrIncompleteRecord)
+	assert.Equal(t, path.Base(lastSegmentPath), corruptionErr.FileID)
+	assert.Equal(t, int(info.Size()), corruptionErr.Offset)
+
+	logs := bytes.NewBuffer(nil)
+	bc2, err := New(append(opts, WithLogger(log.New(logs, "", 0)))...)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc2)
+	defer bc2.Close()
+	assert.Contains(t, logs.String(), "truncated torn tail")
+
+	truncatedInfo, err := os.Stat(lastSegmentPath)
+	assert.Nil(t, err)
+	assert.Equal(t, info.Size(), truncatedInfo.Size())
+
+	for i := 0; i < 10; i++ {
+		key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i)
+		fetchedVal, err := bc2.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.EqualValues(t, val, fetchedVal)
+	}
+
+	err = bc2.Put([]byte("key10"), []byte("val10"))
+	assert.Nil(t, err)
+
+	fetchedVal, err := bc2.Get([]byte("key10"))
+	assert.Nil(t, err)
+	assert.EqualValues(t, "val10", fetchedVal)
+}
+
+func TestRecoverCorruptedSegment(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	opts := []OptFn{
+		WithDirName(dirName),
+		WithSegmentSize(128), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	}
+
+	bc, err := New(opts...)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+
+	for i := 0; i < 10; i++ {
+		key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i)
+		err = bc.Put([]byte(key), []byte(val))
+		assert.Nil(t, err)
+	}
+
+	err = bc.Close()
+	assert.Nil(t, err)
+
+	// flip a byte in the value of key1, stored in the first segment
+	entry, _ := bc.keyDir.Get([]byte("key1"))
+	f, err := os.OpenFile(path.Join(dirName, entry.FileID), os.O_WRONLY, 0755)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte("X"), int64(entry.ValuePos))
+	assert.Nil(t, err)
+	f.Close()
+
+	recordOffset := entry.ValuePos - getValuePos([]byte("key1"), 0)
+
+	_, err = New(opts...)
+	var corruptionErr *CorruptionError
+	assert.ErrorAs(t, err, &corruptionErr)
+	assert.ErrorIs(t, err, ErrChecksumNotMatch)
+	assert.Equal(t, entry.FileID, corruptionErr.FileID)
+	assert.Equal(t, recordOffset, corruptionErr.Offset)
+
+	logs := bytes.NewBuffer(nil)
+	bc2, err := New(append(opts,
+		WithRecoveryMode(RecoverySkipCorrupt),
+		WithLogger(log.New(logs, "", 0)),
+	)...)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc2)
+	defer bc2.Close()
+	assert.Contains(t, logs.String(), "skipped corrupted record")
+
+	for i := 0; i < 10; i++ {
+		key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i)
+		fetchedVal, err := bc2.Get([]byte(key))
+		if i == 1 {
+			assert.Equal(t, ErrKeyNotFound, err)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.EqualValues(t, val, fetchedVal)
+	}
+}
+
+func TestRecoverCorruptedRecordSize(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	opts := []OptFn{
+		WithDirName(dirName),
+		WithSegmentSize(1024), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	}
+
+	bc, err := New(opts...)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+
+	for i := 0; i < 5; i++ {
+		key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i)
+		err = bc.Put([]byte(key), []byte(val))
+		assert.Nil(t, err)
+	}
+
+	lastSegmentPath := path.Join(dirName, bc.activeSegment.GetID())
+	err = bc.Close()
+	assert.Nil(t, err)
+
+	info, err := os.Stat(lastSegmentPath)
+	assert.Nil(t, err)
+
+	// the value size of the first record now runs past the end of the file,
+	// yet valid records follow it: this isn't a torn tail
+	f, err := os.OpenFile(lastSegmentPath, os.O_WRONLY, 0755)
+	assert.Nil(t, err)
+	valueSizePos := fileHeaderLen + checksumLen + typeLen + flagsLen + tsLen + expiryLen + keySizeLen
+	_, err = f.WriteAt(uint64ToBytes(1<<40), int64(valueSizePos))
+	assert.Nil(t, err)
+	f.Close()
+
+	_, err = New(opts...)
+	var corruptionErr *CorruptionError
+	assert.ErrorAs(t, err, &corruptionErr)
+	assert.ErrorIs(t, err, ErrIncompleteRecord)
+	assert.Equal(t, fileHeaderLen, corruptionErr.Offset)
+
+	corruptedInfo, err := os.Stat(lastSegmentPath)
+	assert.Nil(t, err)
+	assert.Equal(t, info.Size(), corruptedInfo.Size())
+
+	logs := bytes.NewBuffer(nil)
+	bc2, err := New(append(opts,
+		WithRecoveryMode(RecoverySkipCorrupt),
+		WithLogger(log.New(logs, "", 0)),
+	)...)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc2)
+	defer bc2.Close()
+	assert.Contains(t, logs.String(), "skipped corrupted record")
+
+	for i := 0; i < 5; i++ {
+		key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i)
+		fetchedVal, err := bc2.Get([]byte(key))
+		if i == 0 {
+			assert.Equal(t, ErrKeyNotFound, err)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.EqualValues(t, val, fetchedVal)
+	}
+}
+
+func TestPutWithTTL(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	bc, err := New(
+		WithDirName(dirName),
+		WithSegmentSize(128), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+	defer bc.Close()
+
+	err = bc.PutWithTTL([]byte("key1"), []byte("val1"), 50*time.Millisecond)
+	assert.Nil(t, err)
+
+	err = bc.Put([]byte("key2"), []byte("val2"))
+	assert.Nil(t, err)
+
+	fetchedVal, err := bc.Get([]byte("key1"))
+	assert.Nil(t, err)
+	assert.EqualValues(t, "val1", fetchedVal)
+
+	<-time.After(100 * time.Millisecond)
+
+	_, err = bc.Get([]byte("key1"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	keys := bc.ListKeys()
+	assert.Equal(t, 1, len(keys))
+	assert.EqualValues(t, "key2", keys[0])
+
+	err = bc.Fold(func(key, val []byte) error {
+		assert.EqualValues(t, "key2", key)
+		return nil
+	})
+	assert.Nil(t, err)
+
+	err = bc.Delete([]byte("key1"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	err = bc.PutIfNotExists([]byte("key1"), []byte("val1"))
+	assert.Nil(t, err)
+}
+
+func TestTTLSurvivesRestart(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	bc, err := New(
+		WithDirName(dirName),
+		WithSegmentSize(128), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+
+	for i := 0; i < 10; i++ {
+		key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i)
+		err = bc.PutWithTTL([]byte(key), []byte(val), time.Hour)
+		assert.Nil(t, err)
+	}
+
+	err = bc.PutWithTTL([]byte("shortlived"), []byte("val"), 200*time.Millisecond)
+	assert.Nil(t, err)
+
+	err = bc.Close()
+	assert.Nil(t, err)
+
+	// warm up from data files
+	bc2, err := New(
+		WithDirName(dirName),
+		WithSegmentSize(128), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 50 * time.Millisecond,
+		}),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc2)
+
+	entry, exist := bc2.keyDir.Get([]byte("shortlived"))
+	assert.True(t, exist)
+	assert.NotZero(t, entry.Expiry)
+
+	// wait for the key to expire and for the data files to be merged
+	<-time.After(300 * time.Millisecond)
+
+	_, err = bc2.Get([]byte("shortlived"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	err = bc2.Close()
+	assert.Nil(t, err)
+
+	// warm up from hint files
+	bc3, err := New(
+		WithDirName(dirName),
+		WithSegmentSize(128), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc3)
+	defer bc3.Close()
+
+	_, err = bc3.Get([]byte("shortlived"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	mergedKeys := 0
+	for i := 0; i < 10; i++ {
+		key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i)
+		entry, exist := bc3.keyDir.Get([]byte(key))
+		assert.True(t, exist)
+		assert.NotZero(t, entry.Expiry)
+		if path.Ext(entry.FileID) == ".merge" {
+			mergedKeys++
+		}
+
+		fetchedVal, err := bc3.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.EqualValues(t, val, fetchedVal)
+	}
+	assert.NotZero(t, mergedKeys)
+}
+
+func TestScan(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	bc, err := New(
+		WithDirName(dirName),
+		WithSegmentSize(1024), // bytes
+		WithIndex(BTreeIndex),
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+	defer bc.Close()
+
+	for _, user := range []string{"user:1", "user:2", "user:3"} {
+		for day := 1; day <= 5; day++ {
+			key := fmt.Sprintf("%v:2026-10-%02d", user, day)
+			err = bc.Put([]byte(key), []byte(key))
+			assert.Nil(t, err)
+		}
+	}
+
+	keys := make([]string, 0)
+	err = bc.PrefixScan([]byte("user:2:"), func(key, val []byte) error {
+		assert.EqualValues(t, key, val)
+		keys = append(keys, string(key))
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"user:2:2026-10-01",
+		"user:2:2026-10-02",
+		"user:2:2026-10-03",
+		"user:2:2026-10-04",
+		"user:2:2026-10-05",
+	}, keys)
+
+	keys = keys[:0]
+	err = bc.Scan([]byte("user:1:2026-10-04"), []byte("user:2:2026-10-02"), func(key, val []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"user:1:2026-10-04",
+		"user:1:2026-10-05",
+		"user:2:2026-10-01",
+	}, keys)
+
+	keys = keys[:0]
+	err = bc.ReverseScan([]byte("user:3:"), nil, func(key, val []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"user:3:2026-10-05",
+		"user:3:2026-10-04",
+		"user:3:2026-10-03",
+		"user:3:2026-10-02",
+		"user:3:2026-10-01",
+	}, keys)
+
+	allKeys := bc.ListKeys()
+	assert.Equal(t, 15, len(allKeys))
+	assert.EqualValues(t, "user:1:2026-10-01", allKeys[0])
+	assert.EqualValues(t, "user:3:2026-10-05", allKeys[len(allKeys)-1])
+}
+
+func TestScanRequiresOrderedIndex(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	bc, err := New(
+		WithDirName(dirName),
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+	defer bc.Close()
+
+	err = bc.PrefixScan([]byte("user:"), func(key, val []byte) error {
+		return nil
+	})
+	assert.Equal(t, ErrIndexNotOrdered, err)
+}
+
+func TestDeleteSurvivesRestart(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	opts := []OptFn{
+		WithDirName(dirName),
+		WithSegmentSize(128), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	}
+
+	bc, err := New(opts...)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+
+	for i := 0; i < 10; i++ {
+		err = bc.Put([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("val%v", i)))
+		assert.Nil(t, err)
+	}
+
+	err = bc.Delete([]byte("key1"))
+	assert.Nil(t, err)
+
+	batch := bc.NewBatch()
+	batch.Delete([]byte("key2"))
+	batch.Put([]byte("key3"), []byte("new3"))
+	err = batch.Commit()
+	assert.Nil(t, err)
+
+	// the bytes tombstones used to be are an ordinary value
+	err = bc.Put([]byte("magic"), tombstoneValue)
+	assert.Nil(t, err)
+
+	check := func() {
+		for i := 0; i < 10; i++ {
+			key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i)
+			if i == 3 {
+				val = "new3"
+			}
+
+			fetchedVal, err := bc.Get([]byte(key))
+			if i == 1 || i == 2 {
+				assert.Equal(t, ErrKeyNotFound, err, key)
+				continue
+			}
+			assert.Nil(t, err)
+			assert.EqualValues(t, val, fetchedVal)
+		}
+
+		fetchedVal, err := bc.Get([]byte("magic"))
+		assert.Nil(t, err)
+		assert.Equal(t, tombstoneValue, fetchedVal)
+	}
+	check()
+
+	err = bc.Close()
+	assert.Nil(t, err)
+
+	bc, err = New(opts...)
+	assert.Nil(t, err)
+	check()
+
+	err = bc.Merge(context.Background())
+	assert.Nil(t, err)
+	check()
+
+	err = bc.Close()
+	assert.Nil(t, err)
+
+	bc, err = New(opts...)
+	assert.Nil(t, err)
+	defer bc.Close()
+	check()
+}
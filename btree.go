@@ -0,0 +1,455 @@
+package gobitcask
+
+import "sort"
+
+const (
+	btreeDegree   = 32
+	btreeMaxItems = 2*btreeDegree - 1
+	btreeMinItems = btreeDegree - 1
+)
+
+type btreeItem struct {
+	key   string
+	entry *Entry
+}
+
+type btreeNode struct {
+	items    []btreeItem
+	children []*btreeNode
+	cow      *btreeCow
+}
+
+// btreeCow identifies the tree that owns a node. Nodes owned by another tree
+// are shared with a clone and copied before they are modified.
+type btreeCow struct {
+	_ int // make sure every btreeCow has a distinct address
+}
+
+// btree is an in-memory B-tree mapping keys to entries in key order. It is
+// not safe for concurrent use, but clone is cheap and the clone can be read
+// while the original is modified.
+type btree struct {
+	root   *btreeNode
+	length int
+	cow    *btreeCow
+}
+
+// clone returns a copy of the tree in O(1). Both trees share their nodes
+// until either of them modifies a node, which copies it first.
+func (t *btree) clone() *btree {
+	out := *t
+	t.cow = &btreeCow{}
+	out.cow = &btreeCow{}
+	return &out
+}
+
+func (t *btree) get(key string) (*Entry, bool) {
+	n := t.root
+	for n != nil {
+		i, found := n.find(key)
+		if found {
+			return n.items[i].entry, true
+		}
+		if len(n.children) == 0 {
+			return nil, false
+		}
+		n = n.children[i]
+	}
+
+	return nil, false
+}
+
+func (t *btree) set(key string, entry *Entry) {
+	if t.root == nil {
+		t.root = &btreeNode{items: []btreeItem{{key: key, entry: entry}}, cow: t.cow}
+		t.length++
+		return
+	}
+
+	t.root = t.root.mutableFor(t.cow)
+	if len(t.root.items) >= btreeMaxItems {
+		item, next := t.root.split(btreeMaxItems / 2)
+		t.root = &btreeNode{
+			items:    []btreeItem{item},
+			children: []*btreeNode{t.root, next},
+			cow:      t.cow,
+		}
+	}
+
+	if !t.root.insert(key, entry) {
+		t.length++
+	}
+}
+
+func (t *btree) delete(key string) {
+	if t.root == nil {
+		return
+	}
+
+	t.root = t.root.mutableFor(t.cow)
+	_, removed := t.root.remove(key, false)
+	if removed {
+		t.length--
+	}
+
+	if len(t.root.items) == 0 {
+		if len(t.root.children) > 0 {
+			t.root = t.root.children[0]
+		} else {
+			t.root = nil
+		}
+	}
+}
+
+// ascend calls fn for every key in [start, end) in ascending order until fn
+// returns false. A nil start or end leaves that side of the range open.
+func (t *btree) ascend(start, end []byte, fn func(item btreeItem) bool) {
+	if t.root != nil {
+		t.root.ascend(start, end, fn)
+	}
+}
+
+// descend calls fn for every key in [start, end) in descending order until fn
+// returns false. A nil start or end leaves that side of the range open.
+func (t *btree) descend(start, end []byte, fn func(item btreeItem) bool) {
+	if t.root != nil {
+		t.root.descend(start, end, fn)
+	}
+}
+
+// mutableFor returns n if it's owned by cow, or a copy of n owned by cow.
+func (n *btreeNode) mutableFor(cow *btreeCow) *btreeNode {
+	if n.cow == cow {
+		return n
+	}
+
+	out := &btreeNode{cow: cow}
+	out.items = append(out.items, n.items...)
+	if len(n.children) > 0 {
+		out.children = append(out.children, n.children...)
+	}
+
+	return out
+}
+
+func (n *btreeNode) mutableChild(i int) *btreeNode {
+	child := n.children[i].mutableFor(n.cow)
+	n.children[i] = child
+	return child
+}
+
+// find returns the index of the first item whose key is not less than key,
+// and whether that item holds key exactly.
+func (n *btreeNode) find(key string) (int, bool) {
+	i := sort.Search(len(n.items), func(i int) bool {
+		return n.items[i].key >= key
+	})
+
+	return i, i < len(n.items) && n.items[i].key == key
+}
+
+// split moves the items after index i, and their children, to a new node and
+// returns it together with the item at index i.
+func (n *btreeNode) split(i int) (btreeItem, *btreeNode) {
+	item := n.items[i]
+
+	next := &btreeNode{cow: n.cow}
+	next.items = append(next.items, n.items[i+1:]...)
+	clear(n.items[i:])
+	n.items = n.items[:i]
+
+	if len(n.children) > 0 {
+		next.children = append(next.children, n.children[i+1:]...)
+		clear(n.children[i+1:])
+		n.children = n.children[:i+1]
+	}
+
+	return item, next
+}
+
+// insert sets key in the subtree of n, which must not be full, and reports
+// whether an existing item was replaced.
+func (n *btreeNode) insert(key string, entry *Entry) bool {
+	i, found := n.find(key)
+	if found {
+		n.items[i].entry = entry
+		return true
+	}
+
+	if len(n.children) == 0 {
+		n.insertItemAt(i, btreeItem{key: key, entry: entry})
+		return false
+	}
+
+	if len(n.children[i].items) >= btreeMaxItems {
+		item, next := n.mutableChild(i).split(btreeMaxItems / 2)
+		n.insertItemAt(i, item)
+		n.insertChildAt(i+1, next)
+
+		switch {
+		case key == item.key:
+			n.items[i].entry = entry
+			return true
+		case key > item.key:
+			i++
+		}
+	}
+
+	return n.mutableChild(i).insert(key, entry)
+}
+
+// remove deletes key, or the largest item if removeMax is set, from the
+// subtree of n. Every node on the way down is made to hold more than the
+// minimum number of items first, so that removing from a leaf never leaves
+// it underfull.
+func (n *btreeNode) remove(key string, removeMax bool) (btreeItem, bool) {
+	var i int
+	var found bool
+
+	if removeMax {
+		if len(n.children) == 0 {
+			return n.removeItemAt(len(n.items) - 1), true
+		}
+		i = len(n.items)
+	} else {
+		i, found = n.find(key)
+		if len(n.children) == 0 {
+			if !found {
+				return btreeItem{}, false
+			}
+			return n.removeItemAt(i), true
+		}
+	}
+
+	if len(n.children[i].items) <= btreeMinItems {
+		n.growChild(i)
+		return n.remove(key, removeMax)
+	}
+
+	if found {
+		// replace the item with its predecessor, the largest item of the
+		// child right before it
+		item := n.items[i]
+		n.items[i], _ = n.mutableChild(i).remove("", true)
+		return item, true
+	}
+
+	return n.mutableChild(i).remove(key, removeMax)
+}
+
+// growChild gives child i more than the minimum number of items, either by
+// taking an item from one of its siblings or by merging it with one.
+func (n *btreeNode) growChild(i int) {
+	switch {
+	case i > 0 && len(n.children[i-1].items) > btreeMinItems:
+		child, left := n.mutableChild(i), n.mutableChild(i-1)
+
+		child.insertItemAt(0, n.items[i-1])
+		n.items[i-1] = left.removeItemAt(len(left.items) - 1)
+		if len(left.children) > 0 {
+			child.insertChildAt(0, left.removeChildAt(len(left.children)-1))
+		}
+	case i < len(n.items) && len(n.children[i+1].items) > btreeMinItems:
+		child, right := n.mutableChild(i), n.mutableChild(i+1)
+
+		child.items = append(child.items, n.items[i])
+		n.items[i] = right.removeItemAt(0)
+		if len(right.children) > 0 {
+			child.children = append(child.children, right.removeChildAt(0))
+		}
+	default:
+		if i >= len(n.items) {
+			i--
+		}
+		child := n.mutableChild(i)
+
+		item := n.removeItemAt(i)
+		right := n.removeChildAt(i + 1)
+		child.items = append(child.items, item)
+		child.items = append(child.items, right.items...)
+		child.children = append(child.children, right.children...)
+	}
+}
+
+func (n *btreeNode) ascend(start, end []byte, fn func(item btreeItem) bool) bool {
+	i := 0
+	if start != nil {
+		i, _ = n.find(string(start))
+	}
+
+	for ; i < len(n.items); i++ {
+		if len(n.children) > 0 && !n.children[i].ascend(start, end, fn) {
+			return false
+		}
+
+		if end != nil && n.items[i].key >= string(end) {
+			return false
+		}
+
+		if !fn(n.items[i]) {
+			return false
+		}
+	}
+
+	if len(n.children) > 0 {
+		return n.children[len(n.children)-1].ascend(start, end, fn)
+	}
+
+	return true
+}
+
+func (n *btreeNode) descend(start, end []byte, fn func(item btreeItem) bool) bool {
+	i := len(n.items)
+	if end != nil {
+		i, _ = n.find(string(end))
+	}
+
+	if len(n.children) > 0 && !n.children[i].descend(start, end, fn) {
+		return false
+	}
+
+	for i--; i >= 0; i-- {
+		if start != nil && n.items[i].key < string(start) {
+			return false
+		}
+
+		if !fn(n.items[i]) {
+			return false
+		}
+
+		if len(n.children) > 0 && !n.children[i].descend(start, end, fn) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (n *btreeNode) insertItemAt(i int, item btreeItem) {
+	n.items = append(n.items, btreeItem{})
+	copy(n.items[i+1:], n.items[i:])
+	n.items[i] = item
+}
+
+func (n *btreeNode) removeItemAt(i int) btreeItem {
+	item := n.items[i]
+	copy(n.items[i:], n.items[i+1:])
+	n.items[len(n.items)-1] = btreeItem{}
+	n.items = n.items[:len(n.items)-1]
+	return item
+}
+
+func (n *btreeNode) insertChildAt(i int, child *btreeNode) {
+	n.children = append(n.children, nil)
+	copy(n.children[i+1:], n.children[i:])
+	n.children[i] = child
+}
+
+func (n *btreeNode) removeChildAt(i int) *btreeNode {
+	child := n.children[i]
+	copy(n.children[i:], n.children[i+1:])
+	n.children[len(n.children)-1] = nil
+	n.children = n.children[:len(n.children)-1]
+	return child
+}
+
+// btreeCursor walks the items of a tree in order. The tree must not be
+// modified while the cursor is in use, which is why cursors are only created
+// on clones.
+type btreeCursor struct {
+	stack   []btreeFrame
+	start   []byte
+	end     []byte
+	reverse bool
+}
+
+// btreeFrame is a node on the path to the next item. Going forward, the next
+// item of the node is items[i]; going backward, it's items[i-1].
+type btreeFrame struct {
+	node *btreeNode
+	i    int
+}
+
+// cursor returns a cursor over the keys in [start, end), in descending order
+// if reverse is set. A nil start or end leaves that side of the range open.
+func (t *btree) cursor(start, end []byte, reverse bool) *btreeCursor {
+	c := &btreeCursor{
+		start:   start,
+		end:     end,
+		reverse: reverse,
+	}
+
+	if reverse {
+		c.pushPath(t.root, end)
+	} else {
+		c.pushPath(t.root, start)
+	}
+
+	return c
+}
+
+// pushPath pushes the path from n down to the leaf where the iteration
+// starts, i.e. the position of bound, or the first or last item if bound is
+// nil.
+func (c *btreeCursor) pushPath(n *btreeNode, bound []byte) {
+	for n != nil {
+		i := 0
+		switch {
+		case bound != nil:
+			i, _ = n.find(string(bound))
+		case c.reverse:
+			i = len(n.items)
+		}
+
+		c.stack = append(c.stack, btreeFrame{node: n, i: i})
+		if len(n.children) == 0 {
+			return
+		}
+		n = n.children[i]
+	}
+}
+
+func (c *btreeCursor) next() (btreeItem, bool) {
+	for len(c.stack) > 0 {
+		frame := &c.stack[len(c.stack)-1]
+
+		var item btreeItem
+		if c.reverse {
+			if frame.i == 0 {
+				c.stack = c.stack[:len(c.stack)-1]
+				continue
+			}
+
+			frame.i--
+			item = frame.node.items[frame.i]
+			if len(frame.node.children) > 0 {
+				c.pushPath(frame.node.children[frame.i], nil)
+			}
+
+			if c.start != nil && item.key < string(c.start) {
+				c.stack = nil
+				return btreeItem{}, false
+			}
+		} else {
+			if frame.i >= len(frame.node.items) {
+				c.stack = c.stack[:len(c.stack)-1]
+				continue
+			}
+
+			item = frame.node.items[frame.i]
+			frame.i++
+			if len(frame.node.children) > 0 {
+				c.pushPath(frame.node.children[frame.i], nil)
+			}
+
+			if c.end != nil && item.key >= string(c.end) {
+				c.stack = nil
+				return btreeItem{}, false
+			}
+		}
+
+		return item, true
+	}
+
+	return btreeItem{}, false
+}
@@ -0,0 +1,134 @@
+package gobitcask
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBTreeRandomOperations(t *testing.T) {
+	tree := &btree{}
+	expected := make(map[string]*Entry)
+
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		key := fmt.Sprintf("key%05d", rnd.Intn(5000))
+
+		if rnd.Intn(3) == 0 {
+			tree.delete(key)
+			delete(expected, key)
+			continue
+		}
+
+		entry := &Entry{ValuePos: i}
+		tree.set(key, entry)
+		expected[key] = entry
+	}
+
+	assert.Equal(t, len(expected), tree.length)
+
+	for key, entry := range expected {
+		fetchedEntry, ok := tree.get(key)
+		assert.True(t, ok)
+		assert.Equal(t, entry, fetchedEntry)
+	}
+
+	_, ok := tree.get("missing")
+	assert.False(t, ok)
+
+	sortedKeys := make([]string, 0, len(expected))
+	for key := range expected {
+		sortedKeys = append(sortedKeys, key)
+	}
+	sort.Strings(sortedKeys)
+
+	ascended := make([]string, 0, len(expected))
+	tree.ascend(nil, nil, func(item btreeItem) bool {
+		ascended = append(ascended, item.key)
+		return true
+	})
+	assert.Equal(t, sortedKeys, ascended)
+
+	descended := make([]string, 0, len(expected))
+	tree.descend(nil, nil, func(item btreeItem) bool {
+		descended = append(descended, item.key)
+		return true
+	})
+	for i, j := 0, len(descended)-1; i < j; i, j = i+1, j-1 {
+		descended[i], descended[j] = descended[j], descended[i]
+	}
+	assert.Equal(t, sortedKeys, descended)
+
+	for key := range expected {
+		tree.delete(key)
+	}
+	assert.Zero(t, tree.length)
+	assert.Nil(t, tree.root)
+}
+
+func TestBTreeRange(t *testing.T) {
+	tree := &btree{}
+	for i := 0; i < 1000; i++ {
+		tree.set(fmt.Sprintf("key%04d", i), &Entry{ValuePos: i})
+	}
+
+	keys := make([]string, 0)
+	tree.ascend([]byte("key0100"), []byte("key0200"), func(item btreeItem) bool {
+		keys = append(keys, item.key)
+		return true
+	})
+	assert.Equal(t, 100, len(keys))
+	assert.Equal(t, "key0100", keys[0])
+	assert.Equal(t, "key0199", keys[len(keys)-1])
+
+	keys = keys[:0]
+	tree.descend([]byte("key0100"), []byte("key0200"), func(item btreeItem) bool {
+		keys = append(keys, item.key)
+		return len(keys) < 10
+	})
+	assert.Equal(t, 10, len(keys))
+	assert.Equal(t, "key0199", keys[0])
+	assert.Equal(t, "key0190", keys[len(keys)-1])
+}
+
+func TestBTreeCloneAndCursor(t *testing.T) {
+	tree := &btree{}
+	for i := 0; i < 1000; i++ {
+		tree.set(fmt.Sprintf("key%04d", i), &Entry{ValuePos: i})
+	}
+
+	clone := tree.clone()
+	for i := 0; i < 1000; i += 2 {
+		tree.delete(fmt.Sprintf("key%04d", i))
+	}
+	for i := 1; i < 1000; i += 2 {
+		tree.set(fmt.Sprintf("key%04d", i), &Entry{ValuePos: -i})
+	}
+	assert.Equal(t, 500, tree.length)
+
+	// the clone still holds every key with its original entry
+	cursor := clone.cursor(nil, nil, false)
+	for i := 0; i < 1000; i++ {
+		item, ok := cursor.next()
+		assert.True(t, ok)
+		assert.Equal(t, fmt.Sprintf("key%04d", i), item.key)
+		assert.Equal(t, i, item.entry.ValuePos)
+	}
+	_, ok := cursor.next()
+	assert.False(t, ok)
+
+	cursor = tree.cursor([]byte("key0100"), []byte("key0200"), true)
+	keys := make([]string, 0)
+	for item, ok := cursor.next(); ok; item, ok = cursor.next() {
+		i := 199 - 2*len(keys)
+		assert.Equal(t, fmt.Sprintf("key%04d", i), item.key)
+		assert.Equal(t, -i, item.entry.ValuePos)
+		keys = append(keys, item.key)
+	}
+	assert.Equal(t, 50, len(keys))
+	assert.Equal(t, "key0199", keys[0])
+	assert.Equal(t, "key0101", keys[len(keys)-1])
+}
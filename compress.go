@@ -0,0 +1,227 @@
+package gobitcask
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressor compresses values before they're written. Records keep the ID
+// of the compressor that compressed them, so data files can mix values
+// compressed by different compressors with uncompressed ones.
+type Compressor interface {
+	// ID identifies the compressor in the records it compressed. It must be
+	// between 1 and 15, New fails with ErrInvalidOption otherwise, and stay
+	// the same once records were written with it. 1 to 4 are taken by the
+	// gzip, flate, snappy and zstd compressors of this package.
+	ID() byte
+	Compress(src []byte) ([]byte, error)
+	Decompress(src []byte) ([]byte, error)
+}
+
+const (
+	gzipCompressorID   = 1
+	flateCompressorID  = 2
+	snappyCompressorID = 3
+	zstdCompressorID   = 4
+
+	// flagCompressorMask selects the ID of the compressor of a record from
+	// its flags, 0 if the value isn't compressed.
+	flagCompressorMask = 0x0f
+)
+
+// NewGzipCompressor returns a Compressor using gzip at the given level, see
+// compress/gzip.
+func NewGzipCompressor(level int) Compressor {
+	return &gzipCompressor{level: level}
+}
+
+type gzipCompressor struct {
+	level int
+}
+
+func (c *gzipCompressor) ID() byte {
+	return gzipCompressorID
+}
+
+func (c *gzipCompressor) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, c.level)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = w.Write(src)
+	if err != nil {
+		return nil, err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (c *gzipCompressor) Decompress(src []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// NewFlateCompressor returns a Compressor using raw DEFLATE at the given
+// level, see compress/flate. It's leaner than gzip for small values.
+func NewFlateCompressor(level int) Compressor {
+	return &flateCompressor{level: level}
+}
+
+type flateCompressor struct {
+	level int
+}
+
+func (c *flateCompressor) ID() byte {
+	return flateCompressorID
+}
+
+func (c *flateCompressor) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, c.level)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = w.Write(src)
+	if err != nil {
+		return nil, err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (c *flateCompressor) Decompress(src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// NewSnappyCompressor returns a Compressor using snappy, which trades some
+// compression for speed.
+func NewSnappyCompressor() Compressor {
+	return &snappyCompressor{}
+}
+
+type snappyCompressor struct{}
+
+func (c *snappyCompressor) ID() byte {
+	return snappyCompressorID
+}
+
+func (c *snappyCompressor) Compress(src []byte) ([]byte, error) {
+	return snappy.Encode(nil, src), nil
+}
+
+func (c *snappyCompressor) Decompress(src []byte) ([]byte, error) {
+	return snappy.Decode(nil, src)
+}
+
+// NewZstdCompressor returns a Compressor using zstd at the given level, from
+// 1 (fastest) to 22 (smallest), see zstd.EncoderLevelFromZstd.
+func NewZstdCompressor(level int) Compressor {
+	return &zstdCompressor{level: zstd.EncoderLevelFromZstd(level)}
+}
+
+type zstdCompressor struct {
+	level zstd.EncoderLevel
+
+	once    sync.Once
+	encoder *zstd.Encoder
+	err     error
+}
+
+// zstdDecoder decompresses the values of every zstd compressor, it's safe
+// for concurrent use.
+var zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) {
+	return zstd.NewReader(nil)
+})
+
+func (c *zstdCompressor) ID() byte {
+	return zstdCompressorID
+}
+
+func (c *zstdCompressor) Compress(src []byte) ([]byte, error) {
+	c.once.Do(func() {
+		c.encoder, c.err = zstd.NewWriter(nil, zstd.WithEncoderLevel(c.level))
+	})
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	return c.encoder.EncodeAll(src, nil), nil
+}
+
+func (c *zstdCompressor) Decompress(src []byte) ([]byte, error) {
+	decoder, err := zstdDecoder()
+	if err != nil {
+		return nil, err
+	}
+
+	return decoder.DecodeAll(src, nil)
+}
+
+// compressValue compresses val with the configured compressor and returns
+// it with the flags of its record. Values that don't get smaller are kept
+// as they are.
+func (o *Option) compressValue(val []byte) ([]byte, byte, error) {
+	if o.Compressor == nil {
+		return val, 0, nil
+	}
+
+	compressed, err := o.Compressor.Compress(val)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(compressed) >= len(val) {
+		return val, 0, nil
+	}
+
+	return compressed, o.Compressor.ID(), nil
+}
+
+// decodeValue returns the value of diskEntry as it was written by the user.
+// The configured compressor is used for the values it compressed, the ones
+// of this package for theirs.
+func (o *Option) decodeValue(diskEntry *DiskEntry) ([]byte, error) {
+	id := diskEntry.Flags & flagCompressorMask
+	switch {
+	case id == 0:
+		return diskEntry.Value, nil
+	case o.Compressor != nil && o.Compressor.ID() == id:
+		return o.Compressor.Decompress(diskEntry.Value)
+	case id == gzipCompressorID:
+		return (&gzipCompressor{}).Decompress(diskEntry.Value)
+	case id == flateCompressorID:
+		return (&flateCompressor{}).Decompress(diskEntry.Value)
+	case id == snappyCompressorID:
+		return (&snappyCompressor{}).Decompress(diskEntry.Value)
+	case id == zstdCompressorID:
+		return (&zstdCompressor{}).Decompress(diskEntry.Value)
+	default:
+		return nil, ErrUnknownCompressor
+	}
+}
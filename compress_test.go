@@ -0,0 +1,253 @@
+package gobitcask
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func jsonValue(i int) []byte {
+	return []byte(fmt.Sprintf(`{"id": %v, "name": "user %v", "tags": [%v]}`, i, i, strings.Repeat(`"tag", `, 20)))
+}
+
+func TestCompression(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	bc, err := New(
+		WithDirName(dirName),
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+		WithCompressor(NewGzipCompressor(gzip.BestCompression)),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+	defer bc.Close()
+
+	var written int
+	for i := 0; i < 50; i++ {
+		err = bc.Put([]byte(fmt.Sprintf("key%v", i)), jsonValue(i))
+		assert.Nil(t, err)
+		written += len(jsonValue(i))
+	}
+
+	batch := bc.NewBatch()
+	batch.Put([]byte("batch"), jsonValue(100))
+	err = batch.Commit()
+	assert.Nil(t, err)
+
+	// too small to get any smaller
+	err = bc.Put([]byte("small"), []byte("v"))
+	assert.Nil(t, err)
+
+	info, err := os.Stat(path.Join(dirName, bc.activeSegment.GetID()))
+	assert.Nil(t, err)
+	assert.Less(t, info.Size(), int64(written))
+
+	for i := 0; i < 50; i++ {
+		fetchedVal, err := bc.Get([]byte(fmt.Sprintf("key%v", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, jsonValue(i), fetchedVal)
+	}
+
+	fetchedVal, err := bc.Get([]byte("batch"))
+	assert.Nil(t, err)
+	assert.Equal(t, jsonValue(100), fetchedVal)
+
+	fetchedVal, err = bc.Get([]byte("small"))
+	assert.Nil(t, err)
+	assert.EqualValues(t, "v", fetchedVal)
+
+	snapshot := bc.Snapshot()
+	defer snapshot.Release()
+
+	fetchedVal, err = snapshot.Get([]byte("key7"))
+	assert.Nil(t, err)
+	assert.Equal(t, jsonValue(7), fetchedVal)
+
+	it := bc.Iterator(WithPrefix([]byte("key1")), WithLazyValues())
+	defer it.Close()
+	for it.Next() {
+		var i int
+		fmt.Sscanf(string(it.Key()), "key%v", &i)
+
+		val, err := it.Value()
+		assert.Nil(t, err)
+		assert.Equal(t, jsonValue(i), val)
+	}
+	assert.Nil(t, it.Err())
+}
+
+func TestMergeCompressesOldRecords(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	opts := []OptFn{
+		WithDirName(dirName),
+		WithSegmentSize(512), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	}
+
+	// written before compression is enabled
+	bc, err := New(opts...)
+	assert.Nil(t, err)
+	for i := 0; i < 20; i++ {
+		err = bc.Put([]byte(fmt.Sprintf("key%v", i)), jsonValue(i))
+		assert.Nil(t, err)
+	}
+	err = bc.Close()
+	assert.Nil(t, err)
+
+	bc, err = New(append(opts, WithCompressor(NewFlateCompressor(gzip.DefaultCompression)))...)
+	assert.Nil(t, err)
+	for i := 20; i < 40; i++ {
+		err = bc.Put([]byte(fmt.Sprintf("key%v", i)), jsonValue(i))
+		assert.Nil(t, err)
+	}
+
+	err = bc.Merge(context.Background())
+	assert.Nil(t, err)
+	assert.NotEmpty(t, bc.manifest.MergeFiles)
+
+	for _, fileName := range bc.manifest.MergeFiles {
+		f, err := os.Open(path.Join(dirName, fileName))
+		assert.Nil(t, err)
+
+		info, err := f.Stat()
+		assert.Nil(t, err)
+
+		r, err := newRecordReader(f, int(info.Size()), defaultMergeBufferSize)
+		assert.Nil(t, err)
+		for {
+			diskEntry, _, err := r.next()
+			if err != nil {
+				break
+			}
+			assert.EqualValues(t, flateCompressorID, diskEntry.Flags)
+		}
+		f.Close()
+	}
+
+	err = bc.Close()
+	assert.Nil(t, err)
+
+	// the compressors of the package are known without being configured
+	bc, err = New(opts...)
+	assert.Nil(t, err)
+	defer bc.Close()
+
+	for i := 0; i < 40; i++ {
+		fetchedVal, err := bc.Get([]byte(fmt.Sprintf("key%v", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, jsonValue(i), fetchedVal)
+	}
+}
+
+func TestBuiltinCompressors(t *testing.T) {
+	dirName := "./test"
+
+	compressors := []Compressor{
+		NewGzipCompressor(gzip.DefaultCompression),
+		NewFlateCompressor(gzip.DefaultCompression),
+		NewSnappyCompressor(),
+		NewZstdCompressor(3),
+	}
+
+	ids := make(map[byte]bool)
+	for _, compressor := range compressors {
+		assert.False(t, ids[compressor.ID()], compressor.ID())
+		ids[compressor.ID()] = true
+
+		opts := []OptFn{
+			WithDirName(dirName),
+			WithMergeOpt(&MergeOption{
+				Interval: 6 * time.Hour,
+			}),
+		}
+
+		bc, err := New(append(opts, WithCompressor(compressor))...)
+		assert.Nil(t, err)
+
+		var written int
+		for i := 0; i < 50; i++ {
+			err = bc.Put([]byte(fmt.Sprintf("key%v", i)), jsonValue(i))
+			assert.Nil(t, err)
+			written += len(jsonValue(i))
+		}
+
+		info, err := os.Stat(path.Join(dirName, bc.activeSegment.GetID()))
+		assert.Nil(t, err)
+		assert.Less(t, info.Size(), int64(written), compressor.ID())
+
+		err = bc.Close()
+		assert.Nil(t, err)
+
+		// readable without being configured
+		bc, err = New(opts...)
+		assert.Nil(t, err)
+		for i := 0; i < 50; i++ {
+			fetchedVal, err := bc.Get([]byte(fmt.Sprintf("key%v", i)))
+			assert.Nil(t, err)
+			assert.Equal(t, jsonValue(i), fetchedVal)
+		}
+		err = bc.Close()
+		assert.Nil(t, err)
+
+		os.RemoveAll(dirName)
+	}
+}
+
+// idCompressor is a gzip compressor under another ID.
+type idCompressor struct {
+	Compressor
+	id byte
+}
+
+func (c *idCompressor) ID() byte {
+	return c.id
+}
+
+func TestInvalidCompressorID(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	for _, id := range []byte{0, 16, 255} {
+		_, err := New(
+			WithDirName(dirName),
+			WithMergeOpt(&MergeOption{
+				Interval: 6 * time.Hour,
+			}),
+			WithCompressor(&idCompressor{Compressor: NewGzipCompressor(gzip.DefaultCompression), id: id}),
+		)
+		assert.ErrorIs(t, err, ErrInvalidOption, id)
+	}
+
+	bc, err := New(
+		WithDirName(dirName),
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+		WithCompressor(&idCompressor{Compressor: NewGzipCompressor(gzip.DefaultCompression), id: 15}),
+	)
+	assert.Nil(t, err)
+	defer bc.Close()
+
+	val := bytes.Repeat([]byte("a"), 1000)
+	err = bc.Put([]byte("key"), val)
+	assert.Nil(t, err)
+
+	fetchedVal, err := bc.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, val, fetchedVal)
+}
@@ -1,21 +1,88 @@
 package gobitcask
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 const (
 	checksumLen  = 4
+	typeLen      = 1
+	flagsLen     = 1
 	tsLen        = 4
+	expiryLen    = 8
 	keySizeLen   = 4
 	valueSizeLen = 8
+	headerLen    = checksumLen + typeLen + flagsLen + tsLen + expiryLen + keySizeLen + valueSizeLen
 )
 
-var (
-	tombstoneValue = []byte("bItcA5k_49c266f9-1d18-41da-ab36-092da88e982a")
+type recordType byte
+
+const (
+	recordPut recordType = iota
+	// recordBatch marks the records written by Batch.Commit in files of
+	// versions 1 and 2. Later versions set flagBatch instead.
+	recordBatch
+	// recordBatchCommit ends a batch; its value holds the number of records
+	// in the batch.
+	recordBatchCommit
+	// recordDelete is a tombstone: the key is deleted. It has no value.
+	recordDelete
+	// recordExpiry is a tombstone written by merge in place of an expired
+	// value, so that older values of the key don't come back.
+	recordExpiry
 )
 
+// flagBatch is set in the flags of the records written by Batch.Commit. They
+// only take effect once the commit record of their batch is read.
+const flagBatch = 0x20
+
+// tombstoneValue is the value of the tombstones in files of versions 1 and
+// 2, which don't have recordDelete.
+var tombstoneValue = []byte("bItcA5k_49c266f9-1d18-41da-ab36-092da88e982a")
+
+// isTombstone reports whether the record deletes its key.
+func (t recordType) isTombstone() bool {
+	return t == recordDelete || t == recordExpiry
+}
+
 var (
 	ErrKeyNotFound        = errors.New("key not found")
 	ErrOpenSegmentFailed  = errors.New("open segment failed")
 	ErrChecksumNotMatch   = errors.New("checksum not match")
+	ErrIncompleteRecord   = errors.New("incomplete record")
 	ErrNotEnoughDataFiles = errors.New("not enough data files to merge")
+	ErrDatabaseLocked     = errors.New("database is locked by another process")
+	ErrReadOnly           = errors.New("database is opened in read-only mode")
+	ErrConflict           = errors.New("transaction conflicts with a concurrent write")
+	ErrKeyExists          = errors.New("key already exists")
+	ErrValueMismatch      = errors.New("value does not match")
+	ErrVersionMismatch    = errors.New("version does not match")
+	ErrIndexNotOrdered    = errors.New("index does not support ordered scans")
+	ErrSnapshotReleased   = errors.New("snapshot is released")
+	ErrDirNotEmpty        = errors.New("directory is not empty")
+	ErrInvalidBackup      = errors.New("invalid backup")
+	ErrInvalidManifest    = errors.New("invalid manifest")
+	ErrUnknownCompressor  = errors.New("value is compressed by an unknown compressor")
+	ErrNoKeyProvider      = errors.New("record is encrypted but no key provider is configured")
+	ErrUnknownKey         = errors.New("unknown encryption key")
+	ErrDecryptionFailed   = errors.New("record can't be decrypted")
+	ErrUnsupportedFormat  = errors.New("unsupported file format")
+	ErrInvalidOption      = errors.New("invalid option")
+	ErrMergeAborted       = errors.New("paused merge is aborted by a backup")
 )
+
+// CorruptionError reports a record that can't be decoded.
+type CorruptionError struct {
+	FileID string
+	Offset int
+	Err    error
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("%v is corrupted at offset %v: %v", e.FileID, e.Offset, e.Err)
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,239 @@
+package gobitcask
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"sync"
+)
+
+// KeyProvider supplies the AES keys records are encrypted with, 16, 24 or
+// 32 bytes long. Every record keeps the ID of its key, so that keys can be
+// rotated: new records use the current key, older ones are decrypted with
+// the key they were written with until merging re-encrypts them, see
+// Bitcask.MergeAll.
+type KeyProvider interface {
+	// CurrentKey returns the key new records are encrypted with, and its
+	// ID. It's called for every write.
+	CurrentKey() (id uint32, key []byte, err error)
+	// Key returns the key of the given ID. The key of an ID must never
+	// change.
+	Key(id uint32) ([]byte, error)
+}
+
+// StaticKeys is a KeyProvider holding its keys in memory. The key with the
+// highest ID is the current one.
+type StaticKeys map[uint32][]byte
+
+func (k StaticKeys) CurrentKey() (uint32, []byte, error) {
+	var currentID uint32
+	var current []byte
+	for id, key := range k {
+		if current == nil || id > currentID {
+			currentID, current = id, key
+		}
+	}
+	if current == nil {
+		return 0, nil, ErrUnknownKey
+	}
+
+	return currentID, current, nil
+}
+
+func (k StaticKeys) Key(id uint32) ([]byte, error) {
+	key, ok := k[id]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	return key, nil
+}
+
+const (
+	// flagEncrypted is set in the flags of records and hint records that
+	// are encrypted.
+	flagEncrypted = 0x10
+
+	keyIDLen    = 4
+	gcmNonceLen = 12
+	gcmTagLen   = 16
+	// sealOverhead is the number of bytes encryption adds to a record.
+	sealOverhead = keyIDLen + gcmNonceLen + gcmTagLen
+)
+
+// keyRing encrypts and decrypts records with AES-GCM using the keys of a
+// KeyProvider. A nil keyRing doesn't encrypt anything and fails to decrypt.
+type keyRing struct {
+	provider KeyProvider
+
+	mu    sync.Mutex
+	aeads map[uint32]cipher.AEAD
+}
+
+func newKeyRing(provider KeyProvider) *keyRing {
+	if provider == nil {
+		return nil
+	}
+
+	return &keyRing{
+		provider: provider,
+		aeads:    make(map[uint32]cipher.AEAD),
+	}
+}
+
+func (r *keyRing) current() (uint32, cipher.AEAD, error) {
+	id, key, err := r.provider.CurrentKey()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	aead, err := r.aead(id, key)
+	return id, aead, err
+}
+
+func (r *keyRing) get(id uint32) (cipher.AEAD, error) {
+	r.mu.Lock()
+	aead, ok := r.aeads[id]
+	r.mu.Unlock()
+	if ok {
+		return aead, nil
+	}
+
+	key, err := r.provider.Key(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.aead(id, key)
+}
+
+func (r *keyRing) aead(id uint32, key []byte) (cipher.AEAD, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	aead, ok := r.aeads[id]
+	if ok {
+		return aead, nil
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err = cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	r.aeads[id] = aead
+
+	return aead, nil
+}
+
+// sealData encrypts data with the current key and authenticates it together
+// with aad. It returns the ID of the key, the nonce, the ciphertext and the
+// tag, in this order.
+func (r *keyRing) sealData(data, aad []byte) ([]byte, error) {
+	id, aead, err := r.current()
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := make([]byte, keyIDLen+gcmNonceLen, sealOverhead+len(data))
+	copy(sealed, uint32ToBytes(id))
+
+	_, err = rand.Read(sealed[keyIDLen:])
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(sealed, sealed[keyIDLen:], data, aad), nil
+}
+
+// openData decrypts what sealData returned.
+func (r *keyRing) openData(sealed, aad []byte) ([]byte, error) {
+	if r == nil {
+		return nil, ErrNoKeyProvider
+	}
+	if len(sealed) < sealOverhead {
+		return nil, ErrDecryptionFailed
+	}
+
+	aead, err := r.get(bytesToUint32(sealed))
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := aead.Open(nil, sealed[keyIDLen:keyIDLen+gcmNonceLen], sealed[keyIDLen+gcmNonceLen:], aad)
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+
+	return data, nil
+}
+
+// seal encrypts the key and the value of diskEntry. The ciphertext of the
+// key replaces the key, which keeps its length so that entries still point
+// at the value with getValuePos. The value is replaced with the rest of the
+// sealed data. The header of the record is authenticated as well. A nil
+// keyRing leaves the record as it is.
+func (r *keyRing) seal(diskEntry *DiskEntry) error {
+	if r == nil {
+		return nil
+	}
+
+	diskEntry.Flags |= flagEncrypted
+
+	data := make([]byte, 0, len(diskEntry.Key)+len(diskEntry.Value))
+	data = append(data, diskEntry.Key...)
+	data = append(data, diskEntry.Value...)
+
+	sealed, err := r.sealData(data, recordAAD(diskEntry))
+	if err != nil {
+		return err
+	}
+
+	keyEnd := keyIDLen + gcmNonceLen + len(diskEntry.Key)
+	diskEntry.Key = sealed[keyIDLen+gcmNonceLen : keyEnd]
+	diskEntry.Value = append(sealed[:keyIDLen+gcmNonceLen:keyIDLen+gcmNonceLen], sealed[keyEnd:]...)
+
+	return nil
+}
+
+// open decrypts a record encrypted by seal and verifies it. Records that
+// aren't encrypted are left as they are.
+func (r *keyRing) open(diskEntry *DiskEntry) error {
+	if diskEntry.Flags&flagEncrypted == 0 {
+		return nil
+	}
+	if len(diskEntry.Value) < sealOverhead {
+		return ErrDecryptionFailed
+	}
+
+	sealed := make([]byte, 0, len(diskEntry.Key)+len(diskEntry.Value))
+	sealed = append(sealed, diskEntry.Value[:keyIDLen+gcmNonceLen]...)
+	sealed = append(sealed, diskEntry.Key...)
+	sealed = append(sealed, diskEntry.Value[keyIDLen+gcmNonceLen:]...)
+
+	data, err := r.openData(sealed, recordAAD(diskEntry))
+	if err != nil {
+		return err
+	}
+
+	diskEntry.Flags &^= flagEncrypted
+	diskEntry.Key = data[:len(diskEntry.Key)]
+	diskEntry.Value = data[len(diskEntry.Key):]
+
+	return nil
+}
+
+// recordAAD returns the fields of the header of a record that aren't
+// implied by its length.
+func recordAAD(diskEntry *DiskEntry) []byte {
+	aad := make([]byte, 0, typeLen+flagsLen+tsLen+expiryLen)
+	aad = append(aad, byte(diskEntry.Type), diskEntry.Flags|flagEncrypted)
+	aad = append(aad, uint32ToBytes(diskEntry.Ts)...)
+	aad = append(aad, uint64ToBytes(uint64(diskEntry.Expiry))...)
+
+	return aad
+}
@@ -0,0 +1,234 @@
+package gobitcask
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func TestEncryption(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	opts := []OptFn{
+		WithDirName(dirName),
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	}
+
+	bc, err := New(append(opts, WithKeyProvider(StaticKeys{1: testKey(1)}))...)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+
+	err = bc.Put([]byte("ssn:alice"), []byte("123-45-6789"))
+	assert.Nil(t, err)
+	err = bc.PutWithTTL([]byte("session:alice"), []byte("token"), time.Hour)
+	assert.Nil(t, err)
+	err = bc.Put([]byte("ssn:bob"), []byte("987-65-4321"))
+	assert.Nil(t, err)
+	err = bc.Delete([]byte("ssn:bob"))
+	assert.Nil(t, err)
+	_, err = bc.Get([]byte("ssn:bob"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	batch := bc.NewBatch()
+	batch.Put([]byte("ssn:carol"), []byte("555-55-5555"))
+	err = batch.Commit()
+	assert.Nil(t, err)
+
+	data, err := os.ReadFile(path.Join(dirName, bc.activeSegment.GetID()))
+	assert.Nil(t, err)
+	for _, plain := range []string{"alice", "bob", "carol", "123-45-6789", "token", "555-55-5555"} {
+		assert.False(t, bytes.Contains(data, []byte(plain)), plain)
+	}
+
+	err = bc.Close()
+	assert.Nil(t, err)
+
+	// the key is needed to open the database again
+	_, err = New(opts...)
+	assert.ErrorIs(t, err, ErrNoKeyProvider)
+
+	_, err = New(append(opts, WithKeyProvider(StaticKeys{1: testKey(2)}))...)
+	assert.ErrorIs(t, err, ErrDecryptionFailed)
+
+	bc, err = New(append(opts, WithKeyProvider(StaticKeys{1: testKey(1)}))...)
+	assert.Nil(t, err)
+	defer bc.Close()
+
+	for key, val := range map[string]string{
+		"ssn:alice":     "123-45-6789",
+		"session:alice": "token",
+		"ssn:carol":     "555-55-5555",
+	} {
+		fetchedVal, err := bc.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.EqualValues(t, val, fetchedVal)
+	}
+
+	_, err = bc.Get([]byte("ssn:bob"))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestMergeRotatesEncryptionKey(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	opts := []OptFn{
+		WithDirName(dirName),
+		WithSegmentSize(256), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+		WithCompressor(NewFlateCompressor(-1)),
+	}
+
+	bc, err := New(append(opts, WithKeyProvider(StaticKeys{1: testKey(1)}))...)
+	assert.Nil(t, err)
+	for i := 0; i < 20; i++ {
+		err = bc.Put([]byte(fmt.Sprintf("key%v", i)), jsonValue(i))
+		assert.Nil(t, err)
+	}
+	err = bc.Close()
+	assert.Nil(t, err)
+
+	// rotate: key 2 becomes the current one
+	keys := StaticKeys{1: testKey(1), 2: testKey(2)}
+	bc, err = New(append(opts, WithKeyProvider(keys))...)
+	assert.Nil(t, err)
+	for i := 20; i < 40; i++ {
+		err = bc.Put([]byte(fmt.Sprintf("key%v", i)), jsonValue(i))
+		assert.Nil(t, err)
+	}
+
+	err = bc.Merge(context.Background())
+	assert.Nil(t, err)
+	assert.NotEmpty(t, bc.manifest.MergeFiles)
+
+	for _, fileName := range bc.manifest.MergeFiles {
+		f, err := os.Open(path.Join(dirName, fileName))
+		assert.Nil(t, err)
+
+		info, err := f.Stat()
+		assert.Nil(t, err)
+
+		r, err := newRecordReader(f, int(info.Size()), defaultMergeBufferSize)
+		assert.Nil(t, err)
+		for {
+			diskEntry, _, err := r.next()
+			if err != nil {
+				break
+			}
+			assert.NotZero(t, diskEntry.Flags&flagEncrypted)
+			assert.EqualValues(t, 2, bytesToUint32(diskEntry.Value))
+		}
+		f.Close()
+	}
+
+	// hint files don't leak the keys either
+	for _, hintFilename := range bc.manifest.HintFiles {
+		data, err := os.ReadFile(path.Join(dirName, hintFilename))
+		assert.Nil(t, err)
+		assert.False(t, bytes.Contains(data, []byte("key")))
+	}
+
+	err = bc.Close()
+	assert.Nil(t, err)
+
+	// key 1 can be retired once everything it encrypted is merged
+	bc, err = New(append(opts, WithKeyProvider(StaticKeys{2: testKey(2)}))...)
+	assert.Nil(t, err)
+	defer bc.Close()
+
+	for i := 0; i < 40; i++ {
+		fetchedVal, err := bc.Get([]byte(fmt.Sprintf("key%v", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, jsonValue(i), fetchedVal)
+	}
+}
+
+func TestMergeAllRetiresEncryptionKey(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	opts := []OptFn{
+		WithDirName(dirName),
+		WithSegmentSize(256), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	}
+
+	// the merge files are written with key 1 too
+	bc, err := New(append(opts, WithKeyProvider(StaticKeys{1: testKey(1)}))...)
+	assert.Nil(t, err)
+	for i := 0; i < 20; i++ {
+		err = bc.Put([]byte(fmt.Sprintf("key%v", i)), jsonValue(i))
+		assert.Nil(t, err)
+	}
+	err = bc.Merge(context.Background())
+	assert.Nil(t, err)
+	assert.NotEmpty(t, bc.manifest.MergeFiles)
+	err = bc.Close()
+	assert.Nil(t, err)
+
+	keys := StaticKeys{1: testKey(1), 2: testKey(2)}
+	bc, err = New(append(opts, WithKeyProvider(keys))...)
+	assert.Nil(t, err)
+	err = bc.Put([]byte("key20"), jsonValue(20))
+	assert.Nil(t, err)
+
+	// merge files without garbage are left as they are
+	for i := 0; i < 2; i++ {
+		err = bc.Merge(context.Background())
+		assert.Nil(t, err)
+	}
+
+	err = bc.MergeAll(context.Background())
+	assert.Nil(t, err)
+
+	files := append(slices.Clone(bc.manifest.DataFiles), bc.manifest.MergeFiles...)
+	for _, fileName := range files {
+		f, err := os.Open(path.Join(dirName, fileName))
+		assert.Nil(t, err)
+
+		info, err := f.Stat()
+		assert.Nil(t, err)
+
+		r, err := newRecordReader(f, int(info.Size()), defaultMergeBufferSize)
+		assert.Nil(t, err)
+		for {
+			diskEntry, _, err := r.next()
+			if err != nil {
+				break
+			}
+			assert.EqualValues(t, 2, bytesToUint32(diskEntry.Value), fileName)
+		}
+		f.Close()
+	}
+
+	err = bc.Close()
+	assert.Nil(t, err)
+
+	bc, err = New(append(opts, WithKeyProvider(StaticKeys{2: testKey(2)}))...)
+	assert.Nil(t, err)
+	defer bc.Close()
+
+	for i := 0; i < 21; i++ {
+		fetchedVal, err := bc.Get([]byte(fmt.Sprintf("key%v", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, jsonValue(i), fetchedVal)
+	}
+}
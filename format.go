@@ -0,0 +1,228 @@
+package gobitcask
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// Data, merge and hint files start with a header made of a magic number and
+// the version of the format of the file:
+//
+//	magic(4) | version(4)
+//
+// The records follow the header. Files written before the header was
+// introduced don't have one and are version 1, the format of the first
+// release. Their records start at offset 0 and have neither a type, flags
+// nor an expiry:
+//
+//	crc(4) | ts(4) | ksz(4) | vsz(8) | key | val
+//
+// and their hint records have no flags and no expiry either. Deletes are
+// puts of tombstoneValue. Version 2 adds the header, and the type, flags and
+// expiry of records; version 3 has the same layout, but tells deletes and
+// batches apart by the type and the flags of records rather than by their
+// value. upgradeRecord turns the records of older versions into records of
+// version 3.
+//
+// Readers find the format of a file with parseFileFormat and go through it
+// to decode the records, so a database can hold files of different versions
+// at the same time. Changing the layout of records or hint records takes:
+//
+//   - a new version, which becomes fileVersion and is written by new files,
+//   - decoding for it in fileFormat, keeping the older versions readable,
+//   - bumping formatVersion, which keeps older releases, that can't read the
+//     new files, from opening a database once it has been opened for writing.
+//
+// Records are never appended to a file of an older version: New starts a
+// new segment instead. Files of older versions are rewritten in the current
+// one when they are merged, so upgrading a database only takes opening it
+// with the new release. Support for a version can be dropped once no
+// database in use holds files of that version anymore.
+const (
+	fileMagic = "GOBK"
+
+	fileVersionLen = 4
+	fileHeaderLen  = len(fileMagic) + fileVersionLen
+
+	fileVersion1 = 1 // no header, records without type, flags and expiry
+	fileVersion2 = 2 // magic number and version, record types, flags and expiry
+	fileVersion3 = 3 // tombstone records
+
+	headerLenV1     = checksumLen + tsLen + keySizeLen + valueSizeLen
+	hintHeaderLenV1 = tsLen + keySizeLen + valueSizeLen + valuePosLen
+
+	// fileVersion is the version of the files written by this release.
+	fileVersion = fileVersion3
+)
+
+// fileFormat is the format of a data, merge or hint file.
+type fileFormat struct {
+	version int
+	offset  int // of the first record
+}
+
+var currentFileFormat = fileFormat{version: fileVersion, offset: fileHeaderLen}
+
+// fileHeader returns the header files written by this release start with.
+func fileHeader() []byte {
+	header := make([]byte, 0, fileHeaderLen)
+	header = append(header, fileMagic...)
+	header = append(header, uint32ToBytes(fileVersion)...)
+
+	return header
+}
+
+// parseFileFormat returns the format of a file starting with data, which
+// holds at least the first fileHeaderLen bytes of the file unless the file
+// is shorter. A file cut off within its header, which only happens to a file
+// being created, has no records and is in the current format.
+func parseFileFormat(data []byte) (fileFormat, error) {
+	if len(data) < fileHeaderLen && bytes.HasPrefix(fileHeader(), data) {
+		return currentFileFormat, nil
+	}
+	if len(data) < fileHeaderLen || string(data[:len(fileMagic)]) != fileMagic {
+		return fileFormat{version: fileVersion1}, nil
+	}
+
+	version := int(bytesToUint32(data[len(fileMagic):]))
+	switch version {
+	case fileVersion2, fileVersion3:
+		return fileFormat{version: version, offset: fileHeaderLen}, nil
+	default:
+		return fileFormat{}, fmt.Errorf("%w: version %v", ErrUnsupportedFormat, version)
+	}
+}
+
+// readFileFormat returns the format of the file at filePath.
+func readFileFormat(filePath string) (fileFormat, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return fileFormat{}, err
+	}
+	defer f.Close()
+
+	return readFormat(f)
+}
+
+// readFormat reads the header of f, if any, and returns its format.
+func readFormat(f *os.File) (fileFormat, error) {
+	header := make([]byte, fileHeaderLen)
+	n, err := f.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return fileFormat{}, err
+	}
+
+	return parseFileFormat(header[:n])
+}
+
+// headerLen returns the length of the header of the records of the file.
+func (f fileFormat) headerLen() int {
+	if f.version == fileVersion1 {
+		return headerLenV1
+	}
+
+	return headerLen
+}
+
+// valuePos returns the position of the value of the record of key at offset.
+func (f fileFormat) valuePos(key []byte, offset int) int {
+	return offset + f.headerLen() + len(key)
+}
+
+// recordSizes returns the key and value sizes held by the header of a
+// record, the first headerLen bytes of it.
+func (f fileFormat) recordSizes(header []byte) (keySize, valueSize uint64) {
+	sizesPos := checksumLen + typeLen + flagsLen + tsLen + expiryLen
+	if f.version == fileVersion1 {
+		sizesPos = checksumLen + tsLen
+	}
+
+	return uint64(bytesToUint32(header[sizesPos:])), bytesToUint64(header[sizesPos+keySizeLen:])
+}
+
+// decodeRecord decodes the record at the beginning of data, see the
+// function of the same name.
+func (f fileFormat) decodeRecord(data []byte) (*DiskEntry, int, error) {
+	switch f.version {
+	case fileVersion1:
+		return decodeRecordV1(data)
+	case fileVersion2, fileVersion3:
+		return decodeRecord(data)
+	default:
+		return nil, 0, fmt.Errorf("%w: version %v", ErrUnsupportedFormat, f.version)
+	}
+}
+
+// decodeRecordV1 is decodeRecord for files of version 1. Their records are
+// all puts.
+func decodeRecordV1(data []byte) (*DiskEntry, int, error) {
+	if len(data) < headerLenV1 {
+		return nil, 0, ErrIncompleteRecord
+	}
+
+	checksum := bytesToUint32(data)
+	ts := bytesToUint32(data[checksumLen:])
+	keySize := uint64(bytesToUint32(data[checksumLen+tsLen:]))
+	valueSize := bytesToUint64(data[checksumLen+tsLen+keySizeLen:])
+
+	remaining := uint64(len(data) - headerLenV1)
+	if keySize > remaining || valueSize > remaining-keySize {
+		return nil, 0, ErrIncompleteRecord
+	}
+
+	n := headerLenV1 + int(keySize) + int(valueSize)
+	if checksum != crc32.ChecksumIEEE(data[checksumLen:n]) {
+		return nil, n, ErrChecksumNotMatch
+	}
+
+	return &DiskEntry{
+		Checksum: checksum,
+		Type:     recordPut,
+		Ts:       ts,
+		Key:      data[headerLenV1 : headerLenV1+int(keySize)],
+		Value:    data[headerLenV1+int(keySize) : n],
+	}, n, nil
+}
+
+// upgradeRecord turns a decoded and decrypted record of the file into a
+// record of the current version.
+func (f fileFormat) upgradeRecord(diskEntry *DiskEntry) {
+	if f.version >= fileVersion3 {
+		return
+	}
+
+	if diskEntry.Type == recordBatch {
+		diskEntry.Type = recordPut
+		diskEntry.Flags |= flagBatch
+	}
+	if diskEntry.Type == recordPut && bytes.Equal(diskEntry.Value, tombstoneValue) {
+		diskEntry.Type = recordDelete
+		diskEntry.Value = nil
+	}
+}
+
+// readHintHeader reads the header of the next hint record of the file from r
+// into header, in the layout of the current version. It fails like
+// io.ReadFull.
+func (f fileFormat) readHintHeader(r io.Reader, header []byte) error {
+	if f.version != fileVersion1 {
+		_, err := io.ReadFull(r, header)
+		return err
+	}
+
+	legacy := make([]byte, hintHeaderLenV1)
+	_, err := io.ReadFull(r, legacy)
+	if err != nil {
+		return err
+	}
+
+	// no flags and no expiry
+	clear(header)
+	copy(header[flagsLen:], legacy[:tsLen])
+	copy(header[flagsLen+tsLen+expiryLen:], legacy[tsLen:])
+
+	return nil
+}
@@ -0,0 +1,284 @@
+package gobitcask
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileHeader(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	bc, err := New(
+		WithDirName(dirName),
+		WithSegmentSize(128), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+	defer bc.Close()
+
+	for i := 0; i < 20; i++ {
+		err = bc.Put([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("val%v", i)))
+		assert.Nil(t, err)
+	}
+
+	err = bc.Merge(context.Background())
+	assert.Nil(t, err)
+
+	assert.NotEmpty(t, bc.manifest.MergeFiles)
+	assert.NotEmpty(t, bc.manifest.HintFiles)
+	for _, fileName := range bc.manifest.files() {
+		data, err := os.ReadFile(path.Join(dirName, fileName))
+		assert.Nil(t, err)
+		assert.True(t, bytes.HasPrefix(data, fileHeader()), fileName)
+	}
+}
+
+// copyFixture copies the database of testdata/name to dirName.
+func copyFixture(t *testing.T, name, dirName string) {
+	fixtureDir := path.Join("testdata", name)
+	dirEntries, err := os.ReadDir(fixtureDir)
+	assert.Nil(t, err)
+
+	err = os.MkdirAll(dirName, 0755)
+	assert.Nil(t, err)
+	for _, dirEntry := range dirEntries {
+		data, err := os.ReadFile(path.Join(fixtureDir, dirEntry.Name()))
+		assert.Nil(t, err)
+		err = os.WriteFile(path.Join(dirName, dirEntry.Name()), data, 0644)
+		assert.Nil(t, err)
+	}
+}
+
+// baselineValues are the values held by the database of testdata/v1, written
+// by the first release: key0 to key12 were put, key2 and key4 overwritten,
+// and key3 and key13 deleted, some of them before and some after a merge.
+func baselineValues() map[string]string {
+	values := make(map[string]string)
+	for i := 0; i < 13; i++ {
+		values[fmt.Sprintf("key%v", i)] = fmt.Sprintf("val%v", i)
+	}
+	values["key2"], values["key4"] = "new2", "new4"
+	delete(values, "key3")
+
+	return values
+}
+
+func TestOpenBaselineDatabase(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	copyFixture(t, "v1", dirName)
+
+	sizes := make(map[string]int64)
+	dirEntries, err := os.ReadDir(dirName)
+	assert.Nil(t, err)
+	for _, dirEntry := range dirEntries {
+		info, err := dirEntry.Info()
+		assert.Nil(t, err)
+		sizes[dirEntry.Name()] = info.Size()
+	}
+
+	// none of its records looks corrupted
+	bc, err := New(
+		WithDirName(dirName),
+		WithRecoveryMode(RecoveryStrict),
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	)
+	assert.Nil(t, err)
+	defer bc.Close()
+
+	values := baselineValues()
+	keys := bc.ListKeys()
+	assert.Len(t, keys, len(values))
+	for _, key := range keys {
+		fetchedVal, err := bc.Get(key)
+		assert.Nil(t, err)
+		assert.EqualValues(t, values[string(key)], fetchedVal, string(key))
+	}
+
+	for fileName, size := range sizes {
+		info, err := os.Stat(path.Join(dirName, fileName))
+		assert.Nil(t, err)
+		assert.Equal(t, size, info.Size(), fileName)
+	}
+}
+
+func TestOpenLegacyFiles(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	copyFixture(t, "v1", dirName)
+
+	opts := []OptFn{
+		WithDirName(dirName),
+		WithSegmentSize(128), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	}
+
+	bc, err := New(opts...)
+	assert.Nil(t, err)
+	assert.Equal(t, formatVersion, bc.manifest.FormatVersion)
+
+	// records aren't appended to the segment of the older format
+	format, err := readFileFormat(path.Join(dirName, bc.activeSegment.GetID()))
+	assert.Nil(t, err)
+	assert.Equal(t, currentFileFormat, format)
+
+	values := baselineValues()
+	for i := 20; i < 30; i++ {
+		key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i)
+		err = bc.Put([]byte(key), []byte(val))
+		assert.Nil(t, err)
+		values[key] = val
+	}
+	err = bc.Delete([]byte("key5"))
+	assert.Nil(t, err)
+	delete(values, "key5")
+
+	check := func() {
+		keys := bc.ListKeys()
+		assert.Len(t, keys, len(values))
+		for _, key := range keys {
+			fetchedVal, err := bc.Get(key)
+			assert.Nil(t, err)
+			assert.EqualValues(t, values[string(key)], fetchedVal, string(key))
+		}
+	}
+	check()
+
+	// merging rewrites the old files in the current format
+	err = bc.Merge(context.Background())
+	assert.Nil(t, err)
+	check()
+
+	for _, fileName := range bc.manifest.files() {
+		format, err := readFileFormat(path.Join(dirName, fileName))
+		assert.Nil(t, err)
+		assert.Equal(t, currentFileFormat, format, fileName)
+	}
+
+	err = bc.Close()
+	assert.Nil(t, err)
+
+	bc, err = New(opts...)
+	assert.Nil(t, err)
+	defer bc.Close()
+	check()
+}
+
+func TestUnsupportedFileVersion(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	opts := []OptFn{
+		WithDirName(dirName),
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	}
+
+	bc, err := New(opts...)
+	assert.Nil(t, err)
+	err = bc.Put([]byte("key"), []byte("val"))
+	assert.Nil(t, err)
+	fileName := bc.activeSegment.GetID()
+	err = bc.Close()
+	assert.Nil(t, err)
+
+	// a file written by a newer release
+	f, err := os.OpenFile(path.Join(dirName, fileName), os.O_WRONLY, 0755)
+	assert.Nil(t, err)
+	_, err = f.WriteAt(uint32ToBytes(fileVersion+1), int64(len(fileMagic)))
+	assert.Nil(t, err)
+	f.Close()
+
+	_, err = New(opts...)
+	assert.ErrorIs(t, err, ErrUnsupportedFormat)
+}
+
+func TestOpenLegacyTombstones(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	opts := []OptFn{
+		WithDirName(dirName),
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	}
+
+	bc, err := New(opts...)
+	assert.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		err = bc.Put([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("val%v", i)))
+		assert.Nil(t, err)
+	}
+	fileName := bc.activeSegment.GetID()
+	err = bc.Close()
+	assert.Nil(t, err)
+
+	// turn the data file into one of version 2 that deletes key0 and, in a
+	// batch, key1, writing tombstones as a magic value
+	f, err := os.OpenFile(path.Join(dirName, fileName), os.O_WRONLY, 0755)
+	assert.Nil(t, err)
+	_, err = f.WriteAt(uint32ToBytes(fileVersion2), int64(len(fileMagic)))
+	assert.Nil(t, err)
+	_, err = f.Seek(0, io.SeekEnd)
+	assert.Nil(t, err)
+	for _, diskEntry := range []*DiskEntry{
+		{Type: recordPut, Key: []byte("key0"), Value: tombstoneValue},
+		{Type: recordBatch, Key: []byte("key1"), Value: tombstoneValue},
+		{Type: recordBatchCommit, Value: uint32ToBytes(1)},
+	} {
+		data, err := encode(diskEntry)
+		assert.Nil(t, err)
+		_, err = f.Write(data)
+		assert.Nil(t, err)
+	}
+	f.Close()
+
+	bc, err = New(opts...)
+	assert.Nil(t, err)
+
+	check := func() {
+		for i := 0; i < 3; i++ {
+			key := fmt.Sprintf("key%v", i)
+			fetchedVal, err := bc.Get([]byte(key))
+			if i < 2 {
+				assert.Equal(t, ErrKeyNotFound, err, key)
+				continue
+			}
+			assert.Nil(t, err)
+			assert.EqualValues(t, fmt.Sprintf("val%v", i), fetchedVal)
+		}
+	}
+	check()
+
+	err = bc.Merge(context.Background())
+	assert.Nil(t, err)
+	check()
+
+	err = bc.Close()
+	assert.Nil(t, err)
+
+	bc, err = New(opts...)
+	assert.Nil(t, err)
+	defer bc.Close()
+	check()
+}
@@ -2,7 +2,11 @@ module github.com/ldmtam/go-bitcask
 
 go 1.21.1
 
-require github.com/stretchr/testify v1.8.4
+require (
+	github.com/golang/snappy v1.0.0
+	github.com/klauspost/compress v1.17.11
+	github.com/stretchr/testify v1.8.4
+)
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
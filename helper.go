@@ -3,6 +3,7 @@ package gobitcask
 import (
 	"encoding/binary"
 	"fmt"
+	"os"
 	"strconv"
 	"strings"
 )
@@ -44,3 +45,49 @@ func getHintFilename(id int) string {
 func getMergeFilename(id int) string {
 	return fmt.Sprintf("%06d.merge", id)
 }
+
+// getTmpFilename returns the name fileName is written under until it's
+// complete.
+func getTmpFilename(fileName string) string {
+	return fileName + ".tmp"
+}
+
+// prefixEnd returns the smallest key greater than every key starting with
+// prefix, or nil if there is none.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+
+	return nil
+}
+
+// writeFileSync writes data to filePath and syncs it.
+func writeFileSync(filePath string, data []byte) error {
+	f, err := os.OpenFile(filePath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(data)
+	if err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.Sync()
+}
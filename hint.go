@@ -1,30 +1,28 @@
 package gobitcask
 
 import (
+	"bufio"
 	"bytes"
-	"errors"
 	"io"
 	"os"
 	"path"
 )
 
-type Hint struct {
-	f        *os.File
-	id       string
-	readOnly bool
-}
+const (
+	valuePosLen   = 8
+	hintHeaderLen = flagsLen + tsLen + expiryLen + keySizeLen + valueSizeLen + valuePosLen
 
-func NewHint(dir, id string) (*Hint, error) {
-	filePath := path.Join(dir, id)
-	f, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY, 0755)
-	if err != nil {
-		return nil, err
-	}
+	hintBufferSize = 64 << 10 // 64 KB
 
-	return &Hint{
-		f:  f,
-		id: id,
-	}, nil
+	// flagTombstone is set in the flags of the hint records of tombstones
+	// kept by merge.
+	flagTombstone = 0x40
+)
+
+type Hint struct {
+	f    *os.File
+	id   string
+	keys *keyRing // decrypts the keys, nil if they are in plain text
 }
 
 func OpenHint(dir, id string) (*Hint, error) {
@@ -35,69 +33,100 @@ func OpenHint(dir, id string) (*Hint, error) {
 	}
 
 	return &Hint{
-		f:        f,
-		id:       id,
-		readOnly: true,
+		f:  f,
+		id: id,
 	}, nil
 }
 
-func (h *Hint) Write(keyDir *KeyDir) error {
-	if h.readOnly {
-		return errors.New("can't write to read-only hint")
-	}
+// ForEach calls fn for every entry of the hint file in the order they were
+// written until fn returns false. Entries are read one by one through a
+// buffer, so the file is never loaded into memory as a whole. Tombstones
+// are skipped.
+func (h *Hint) ForEach(fn func(key []byte, entry *Entry) bool) error {
+	return h.forEach(func(key []byte, entry *Entry, tombstone bool) bool {
+		return tombstone || fn(key, entry)
+	})
+}
 
-	for key, entry := range keyDir.kd {
-		rawHint, err := encodeRawHint([]byte(key), entry)
-		if err != nil {
-			return err
-		}
+// forEach is like ForEach but doesn't skip tombstones. The entry of a
+// tombstone points at its record.
+func (h *Hint) forEach(fn func(key []byte, entry *Entry, tombstone bool) bool) error {
+	r := bufio.NewReaderSize(h.f, hintBufferSize)
 
-		_, err = h.f.Write(rawHint)
-		if err != nil {
-			return err
-		}
+	fileHeader, err := r.Peek(fileHeaderLen)
+	if err != nil && err != io.EOF {
+		return err
 	}
 
-	return nil
-}
-
-func (h *Hint) Read() (*KeyDir, error) {
-	buf := bytes.NewBuffer(nil)
+	format, err := parseFileFormat(fileHeader)
+	if err != nil {
+		return err
+	}
 
-	_, err := io.Copy(buf, h.f)
+	_, err = r.Discard(min(format.offset, len(fileHeader)))
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	keyDir := NewKeyDir()
+	header := make([]byte, hintHeaderLen)
+
+	for {
+		err := format.readHintHeader(r, header)
+		if err == io.EOF {
+			return nil
+		} else if err == io.ErrUnexpectedEOF {
+			return ErrIncompleteRecord
+		} else if err != nil {
+			return err
+		}
+
+		// get flags
+		flags := header[0]
 
-	for buf.Len() > 0 {
 		// get timestamp
-		ts := bytesToUint32(buf.Next(tsLen))
+		ts := bytesToUint32(header[flagsLen:])
+
+		// get expiry
+		expiry := int64(bytesToUint64(header[flagsLen+tsLen:]))
 
 		// get key size
-		keySize := bytesToUint32(buf.Next(keySizeLen))
+		keySize := bytesToUint32(header[flagsLen+tsLen+expiryLen:])
 
 		// get value size
-		valueSize := bytesToUint32(buf.Next(valueSizeLen))
+		valueSize := bytesToUint64(header[flagsLen+tsLen+expiryLen+keySizeLen:])
 
 		// get value position
-		valuePos := bytesToUint32(buf.Next(8))
+		valuePos := bytesToUint64(header[flagsLen+tsLen+expiryLen+keySizeLen+valueSizeLen:])
 
 		// get key
-		key := buf.Next(int(keySize))
+		key := make([]byte, keySize)
+		_, err = io.ReadFull(r, key)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrIncompleteRecord
+		} else if err != nil {
+			return err
+		}
+
+		if flags&flagEncrypted != 0 {
+			key, err = h.keys.openData(key, hintAAD(header))
+			if err != nil {
+				return err
+			}
+		}
 
 		entry := &Entry{
 			FileID:    getMergeFilename(extractID(h.id)),
 			ValueSize: int(valueSize),
 			ValuePos:  int(valuePos),
 			Timestamp: ts,
+			Expiry:    expiry,
+			seq:       nextSeq(),
 		}
 
-		keyDir.Set(key, entry)
+		if !fn(key, entry, flags&flagTombstone != 0) {
+			return nil
+		}
 	}
-
-	return keyDir, nil
 }
 
 func (h *Hint) Close() error {
@@ -109,14 +138,36 @@ func (h *Hint) Close() error {
 	return h.f.Close()
 }
 
-func encodeRawHint(key []byte, entry *Entry) ([]byte, error) {
+// encodeRawHint encodes the hint record of key, encrypting the key if keys
+// isn't nil.
+func encodeRawHint(key []byte, entry *Entry, tombstone bool, keys *keyRing) ([]byte, error) {
 	buf := bytes.NewBuffer(nil)
 
-	_, err := buf.Write(uint32ToBytes(entry.Timestamp))
+	var flags byte
+	if tombstone {
+		flags |= flagTombstone
+	}
+	if keys != nil {
+		flags |= flagEncrypted
+	}
+
+	err := buf.WriteByte(flags)
 	if err != nil {
 		return nil, err
 	}
 
+	_, err = buf.Write(uint32ToBytes(entry.Timestamp))
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = buf.Write(uint64ToBytes(uint64(entry.Expiry)))
+	if err != nil {
+		return nil, err
+	}
+
+	// the key is encrypted once the header is complete
+	keySizePos := buf.Len()
 	_, err = buf.Write(uint32ToBytes(uint32(len(key))))
 	if err != nil {
 		return nil, err
@@ -132,6 +183,14 @@ func encodeRawHint(key []byte, entry *Entry) ([]byte, error) {
 		return nil, err
 	}
 
+	if keys != nil {
+		key, err = keys.sealData(key, hintAAD(buf.Bytes()))
+		if err != nil {
+			return nil, err
+		}
+		copy(buf.Bytes()[keySizePos:], uint32ToBytes(uint32(len(key))))
+	}
+
 	_, err = buf.Write(key)
 	if err != nil {
 		return nil, err
@@ -139,3 +198,13 @@ func encodeRawHint(key []byte, entry *Entry) ([]byte, error) {
 
 	return buf.Bytes(), nil
 }
+
+// hintAAD returns the fields of the header of a hint record the encryption
+// of its key authenticates, which are all but the key size.
+func hintAAD(header []byte) []byte {
+	aad := make([]byte, 0, hintHeaderLen-keySizeLen)
+	aad = append(aad, header[:flagsLen+tsLen+expiryLen]...)
+	aad = append(aad, header[flagsLen+tsLen+expiryLen+keySizeLen:hintHeaderLen]...)
+
+	return aad
+}
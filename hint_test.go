@@ -1,57 +1,97 @@
 package gobitcask
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
-func TestCreateNewHint(t *testing.T) {
+func TestOpenMissingHint(t *testing.T) {
 	err := os.MkdirAll("test", 0775)
 	assert.Nil(t, err)
 	defer os.RemoveAll("test")
 
-	h, err := NewHint("test", "1.hint")
-	assert.Nil(t, err)
-	assert.NotNil(t, h)
+	h, err := OpenHint("test", "000001.hint")
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, h)
 }
 
-func TestSimpleWriteReadHint(t *testing.T) {
-	err := os.MkdirAll("test", 0775)
-	assert.Nil(t, err)
-	defer os.RemoveAll("test")
+func TestMergeWriteReadHint(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
 
-	h, err := NewHint("test", "000001.hint")
+	bc, err := New(
+		WithDirName(dirName),
+		WithSegmentSize(128), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	)
 	assert.Nil(t, err)
-	assert.NotNil(t, h)
-
-	keyDir := NewKeyDir()
-	key := []byte("key1")
-	entry := &Entry{
-		FileID:    "000001.merge",
-		ValueSize: 2,
-		ValuePos:  3,
-		Timestamp: uint32(1234),
-	}
+	assert.NotNil(t, bc)
+	defer bc.Close()
 
-	keyDir.Set(key, entry)
+	for i := 0; i < 20; i++ {
+		key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i)
+		err = bc.Put([]byte(key), []byte(val))
+		assert.Nil(t, err)
+	}
 
-	err = h.Write(keyDir)
+	err = bc.Delete([]byte("key0"))
 	assert.Nil(t, err)
 
-	err = h.Close()
+	// rotate, so that every key gets merged
+	err = bc.Put([]byte("filler"), make([]byte, 100))
 	assert.Nil(t, err)
 
-	h2, err := OpenHint("test", "000001.hint")
+	err = bc.Merge(context.Background())
 	assert.Nil(t, err)
-	assert.NotNil(t, h2)
+	assert.NotEmpty(t, bc.manifest.HintFiles)
+
+	// the hint files point at the records of the merge files
+	fetched := make(map[string]*Entry)
+	for _, hintFilename := range bc.manifest.HintFiles {
+		h, err := OpenHint(dirName, hintFilename)
+		assert.Nil(t, err)
 
-	readKeyDir, err := h2.Read()
+		err = h.ForEach(func(key []byte, entry *Entry) bool {
+			fetched[string(key)] = entry
+			return true
+		})
+		assert.Nil(t, err)
+
+		err = h.Close()
+		assert.Nil(t, err)
+	}
+
+	assert.Equal(t, 19, len(fetched))
+	for i := 1; i < 20; i++ {
+		key := fmt.Sprintf("key%v", i)
+		entry, exist := bc.keyDir.Get([]byte(key))
+		assert.True(t, exist)
+
+		fetchedEntry, ok := fetched[key]
+		assert.True(t, ok, key)
+		assert.Equal(t, entry.FileID, fetchedEntry.FileID)
+		assert.Equal(t, entry.ValueSize, fetchedEntry.ValueSize)
+		assert.Equal(t, entry.ValuePos, fetchedEntry.ValuePos)
+		assert.Equal(t, entry.Timestamp, fetchedEntry.Timestamp)
+	}
+
+	// ForEach stops when fn returns false
+	h, err := OpenHint(dirName, bc.manifest.HintFiles[0])
 	assert.Nil(t, err)
-	assert.NotNil(t, readKeyDir)
+	defer h.Close()
 
-	fetchedEntry, exist := readKeyDir.Get(key)
-	assert.True(t, exist)
-	assert.EqualValues(t, entry, fetchedEntry)
+	n := 0
+	err = h.ForEach(func(key []byte, entry *Entry) bool {
+		n++
+		return false
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
 }
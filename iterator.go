@@ -0,0 +1,132 @@
+package gobitcask
+
+// Iterator walks the key/value pairs of the database as they were when it
+// was created: writes and merges that happen meanwhile aren't visible to it.
+// Keys come in ascending order with the BTreeIndex and in no particular
+// order otherwise. An Iterator isn't safe for concurrent use and must be
+// closed, the files it reads from are kept until then.
+//
+//	it := db.Iterator(WithPrefix([]byte("user:")))
+//	defer it.Close()
+//	for it.Next() {
+//		val, err := it.Value()
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type Iterator struct {
+	db      *Bitcask
+	opts    *IterOption
+	cursor  KeyDirCursor
+	release func()
+
+	key    []byte
+	entry  *Entry
+	value  []byte
+	loaded bool
+	err    error
+	closed bool
+}
+
+// Iterator returns an iterator over all the keys, or the ones selected by
+// the options.
+func (b *Bitcask) Iterator(optsFn ...IterOptFn) *Iterator {
+	opts := &IterOption{}
+	for _, optFn := range optsFn {
+		optFn(opts)
+	}
+
+	start, end := opts.bounds()
+	return b.newIterator(start, end, opts)
+}
+
+// newIterator returns an iterator over the keys in [start, end) of a new
+// snapshot of the key dir.
+func (b *Bitcask) newIterator(start, end []byte, opts *IterOption) *Iterator {
+	pin := b.pinFiles()
+	snapshot := b.keyDir.Snapshot()
+
+	return newIterator(b, snapshot, start, end, opts, func() {
+		snapshot.Release()
+		b.unpinFiles(pin)
+	})
+}
+
+// newIterator returns an iterator over the keys in [start, end) of snapshot,
+// whose files must be pinned. release is called on Close.
+func newIterator(db *Bitcask, snapshot KeyDirSnapshot, start, end []byte, opts *IterOption, release func()) *Iterator {
+	it := &Iterator{
+		db:      db,
+		opts:    opts,
+		release: release,
+	}
+
+	it.cursor, it.err = snapshot.Cursor(start, end, opts.Reverse)
+
+	return it
+}
+
+// Next moves to the next key and reports whether there is one. It returns
+// false at the end of the iteration or on error, which Err then returns.
+func (it *Iterator) Next() bool {
+	if it.err != nil || it.closed {
+		return false
+	}
+
+	key, entry, ok := it.cursor.Next()
+	if !ok {
+		return false
+	}
+
+	it.key, it.entry = key, entry
+	it.value, it.loaded = nil, false
+
+	if !it.opts.KeysOnly && !it.opts.LazyValues {
+		_, err := it.Value()
+		if err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Key returns the current key. It's only valid after Next returned true.
+func (it *Iterator) Key() []byte {
+	return it.key
+}
+
+// Value returns the value of the current key, reading it first if values
+// are loaded lazily. It returns nil for a keys-only iterator.
+func (it *Iterator) Value() ([]byte, error) {
+	if it.opts.KeysOnly || it.loaded {
+		return it.value, nil
+	}
+
+	val, err := it.db.read(it.key, it.entry)
+	if err != nil {
+		it.err = err
+		return nil, err
+	}
+
+	it.value, it.loaded = val, true
+	return val, nil
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close releases the iterator. It's safe to call Close more than once.
+func (it *Iterator) Close() error {
+	if it.closed {
+		return nil
+	}
+
+	it.closed = true
+	it.release()
+
+	return nil
+}
@@ -0,0 +1,165 @@
+package gobitcask
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIterator(t *testing.T) {
+	for _, index := range []IndexType{HashIndex, BTreeIndex} {
+		dirName := "./test"
+
+		bc, err := New(
+			WithDirName(dirName),
+			WithSegmentSize(128), // bytes
+			WithIndex(index),
+			WithMergeOpt(&MergeOption{
+				Interval: 6 * time.Hour,
+			}),
+		)
+		assert.Nil(t, err)
+		assert.NotNil(t, bc)
+
+		for i := 0; i < 20; i++ {
+			err = bc.Put([]byte(fmt.Sprintf("a%02d", i)), []byte(fmt.Sprintf("val%v", i)))
+			assert.Nil(t, err)
+			err = bc.Put([]byte(fmt.Sprintf("b%02d", i)), []byte(fmt.Sprintf("val%v", i)))
+			assert.Nil(t, err)
+		}
+
+		// prefix
+		keys := make([]string, 0)
+		it := bc.Iterator(WithPrefix([]byte("b")))
+		for it.Next() {
+			val, err := it.Value()
+			assert.Nil(t, err)
+			i, err := strconv.Atoi(string(it.Key()[1:]))
+			assert.Nil(t, err)
+			assert.EqualValues(t, fmt.Sprintf("val%v", i), val)
+			keys = append(keys, string(it.Key()))
+		}
+		assert.Nil(t, it.Err())
+		assert.Nil(t, it.Close())
+
+		if index == BTreeIndex {
+			assert.True(t, sort.StringsAreSorted(keys))
+		}
+		sort.Strings(keys)
+		assert.Equal(t, 20, len(keys))
+		assert.Equal(t, "b00", keys[0])
+		assert.Equal(t, "b19", keys[19])
+
+		// keys only
+		it = bc.Iterator(WithKeysOnly())
+		count := 0
+		for it.Next() {
+			val, err := it.Value()
+			assert.Nil(t, err)
+			assert.Nil(t, val)
+			count++
+		}
+		assert.Nil(t, it.Err())
+		assert.Nil(t, it.Close())
+		assert.Equal(t, 40, count)
+
+		// lazy values
+		it = bc.Iterator(WithLazyValues(), WithPrefix([]byte("a1")))
+		count = 0
+		for it.Next() {
+			val, err := it.Value()
+			assert.Nil(t, err)
+			assert.EqualValues(t, "val"+string(it.Key()[1:]), val)
+			count++
+		}
+		assert.Nil(t, it.Err())
+		assert.Nil(t, it.Close())
+		assert.Equal(t, 10, count)
+
+		// reverse
+		it = bc.Iterator(WithReverse())
+		if index == HashIndex {
+			assert.False(t, it.Next())
+			assert.Equal(t, ErrIndexNotOrdered, it.Err())
+		} else {
+			assert.True(t, it.Next())
+			assert.EqualValues(t, "b19", it.Key())
+			assert.Nil(t, it.Err())
+		}
+		assert.Nil(t, it.Close())
+
+		bc.Close()
+		os.RemoveAll(dirName)
+	}
+}
+
+func TestIteratorConsistentView(t *testing.T) {
+	for _, index := range []IndexType{HashIndex, BTreeIndex} {
+		dirName := "./test"
+
+		bc, err := New(
+			WithDirName(dirName),
+			WithSegmentSize(128), // bytes
+			WithIndex(index),
+			WithMergeOpt(&MergeOption{
+				Interval: 10 * time.Millisecond,
+			}),
+		)
+		assert.Nil(t, err)
+		assert.NotNil(t, bc)
+
+		for i := 0; i < 100; i++ {
+			key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i)
+			err = bc.Put([]byte(key), []byte(val))
+			assert.Nil(t, err)
+		}
+
+		it := bc.Iterator(WithLazyValues())
+
+		// rewrite everything and let the merger remove the old segments
+		for i := 0; i < 100; i++ {
+			key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("new%v", i)
+			if i%2 == 0 {
+				err = bc.Delete([]byte(key))
+			} else {
+				err = bc.Put([]byte(key), []byte(val))
+			}
+			assert.Nil(t, err)
+		}
+		for i := 100; i < 150; i++ {
+			err = bc.Put([]byte(fmt.Sprintf("key%v", i)), []byte("new"))
+			assert.Nil(t, err)
+		}
+		<-time.After(200 * time.Millisecond)
+
+		found := make(map[string]string)
+		for it.Next() {
+			val, err := it.Value()
+			assert.Nil(t, err)
+			found[string(it.Key())] = string(val)
+		}
+		assert.Nil(t, it.Err())
+		assert.Nil(t, it.Close())
+
+		assert.Equal(t, 100, len(found))
+		for i := 0; i < 100; i++ {
+			assert.Equal(t, fmt.Sprintf("val%v", i), found[fmt.Sprintf("key%v", i)])
+		}
+
+		// while the database itself moved on
+		assert.Equal(t, 100, len(bc.ListKeys()))
+		fetchedVal, err := bc.Get([]byte("key1"))
+		assert.Nil(t, err)
+		assert.EqualValues(t, "new1", fetchedVal)
+		_, err = bc.Get([]byte("key0"))
+		assert.Equal(t, ErrKeyNotFound, err)
+
+		bc.Close()
+		os.RemoveAll(dirName)
+	}
+}
@@ -1,11 +1,13 @@
 package gobitcask
 
 import (
-	"bytes"
-	"hash/crc32"
+	"hash/maphash"
+	"maps"
 	"os"
 	"path"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Entry struct {
@@ -13,129 +15,540 @@ type Entry struct {
 	ValueSize int
 	ValuePos  int
 	Timestamp uint32
+	Expiry    int64 // unix nanoseconds, 0 if the key never expires
+
+	// seq tells the writes of a key apart. Merges move records to other
+	// files but keep their seq, so it identifies a write wherever its record
+	// is, see sameEntry.
+	seq uint64
+}
+
+// lastSeq is the seq of the latest entry. It's shared by all databases, so
+// that an entry of one database is never taken for an entry of another one.
+var lastSeq atomic.Uint64
+
+func nextSeq() uint64 {
+	return lastSeq.Add(1)
+}
+
+func (e *Entry) expired(now int64) bool {
+	return e.Expiry != 0 && e.Expiry <= now
+}
+
+// KeyDir maps every key to the location of its latest value on disk. Entries
+// of expired keys are only returned by Lookup. Implementations are safe for
+// concurrent use.
+type KeyDir interface {
+	Get(key []byte) (*Entry, bool)
+	// Lookup is like Get but also returns the entries of expired keys, which
+	// stay in the key dir until the merge of their value removes them.
+	Lookup(key []byte) (*Entry, bool)
+	Set(key []byte, entry *Entry)
+	Delete(key []byte)
+	// Apply sets all the given entries at once, so that concurrent readers
+	// see either none or all of them. A nil entry deletes its key.
+	Apply(keys [][]byte, entries []*Entry)
+	// CompareAndSet sets key to entry only if it's currently set to old, as
+	// compared by sameEntry, and reports whether it did. A nil entry deletes
+	// the key. Expired entries are compared too.
+	CompareAndSet(key []byte, old, entry *Entry) bool
+	GetKeys() [][]byte
+	// ForEach calls fn for every entry until fn returns false. fn must not
+	// modify the key dir.
+	ForEach(fn func(key []byte, entry *Entry) bool)
+	// Scan is like ForEach but also calls fn for the entries of expired keys,
+	// see Lookup.
+	Scan(fn func(key []byte, entry *Entry) bool)
+	// Snapshot returns a read-only view of the key dir as it is now. Taking
+	// a snapshot doesn't copy the key dir, the parts of it that are modified
+	// afterwards are copied on write instead. The snapshot must be released
+	// once it's no longer used.
+	Snapshot() KeyDirSnapshot
+}
+
+// KeyDirSnapshot is a read-only view of a KeyDir at the time it was taken.
+// Keys are considered expired as of that time too.
+type KeyDirSnapshot interface {
+	Get(key []byte) (*Entry, bool)
+	// Cursor returns a cursor over the keys in [start, end). A nil start or
+	// end leaves that side of the range open. Snapshots of an OrderedKeyDir
+	// return the keys in ascending order, or descending if reverse is set;
+	// others return them in no particular order and fail with
+	// ErrIndexNotOrdered if reverse is set.
+	Cursor(start, end []byte, reverse bool) (KeyDirCursor, error)
+	Release()
+}
+
+// KeyDirCursor walks the entries of a KeyDirSnapshot.
+type KeyDirCursor interface {
+	// Next returns the next key and its entry, or false once all of them
+	// have been returned.
+	Next() ([]byte, *Entry, bool)
+}
+
+// OrderedKeyDir is a KeyDir that keeps its keys sorted. GetKeys and ForEach
+// return the keys in ascending order.
+type OrderedKeyDir interface {
+	KeyDir
+	// Ascend calls fn for every key in [start, end) in ascending order until
+	// fn returns false. A nil start or end leaves that side of the range
+	// open. fn must not modify the key dir.
+	Ascend(start, end []byte, fn func(key []byte, entry *Entry) bool)
+	// Descend is like Ascend but in descending order.
+	Descend(start, end []byte, fn func(key []byte, entry *Entry) bool)
+}
+
+func newKeyDir(index IndexType) KeyDir {
+	switch index {
+	case BTreeIndex:
+		return NewBTreeKeyDir()
+	default:
+		return NewKeyDir()
+	}
+}
+
+// hashKeyDirShards is the number of maps a hashKeyDir is split into. A shard
+// is the unit that gets copied when it's modified while shared with a
+// snapshot.
+const hashKeyDirShards = 256
+
+// hashKeyDir is the default KeyDir backed by hash maps. Keys are spread over
+// shards so that snapshots can share the shards and only the modified ones
+// need to be copied.
+type hashKeyDir struct {
+	mu     sync.RWMutex
+	seed   maphash.Seed
+	shards [hashKeyDirShards]*hashShard
+	// gen is the generation of the shards the key dir may modify in place,
+	// shards of an older generation are shared with a snapshot.
+	gen       uint64
+	snapshots int
 }
 
-type KeyDir struct {
-	kd map[string]*Entry
-	mu sync.RWMutex
+type hashShard struct {
+	kd  map[string]*Entry
+	gen uint64
 }
 
-func NewKeyDir() *KeyDir {
-	return &KeyDir{
-		kd: make(map[string]*Entry),
+func NewKeyDir() KeyDir {
+	k := &hashKeyDir{
+		seed: maphash.MakeSeed(),
 	}
+	for i := range k.shards {
+		k.shards[i] = &hashShard{kd: make(map[string]*Entry)}
+	}
+
+	return k
+}
+
+func shardIndex(seed maphash.Seed, key string) int {
+	return int(maphash.String(seed, key) % hashKeyDirShards)
+}
+
+// mutableShard returns the shard of key, copying it first if it's shared
+// with a snapshot. The caller must hold the write lock.
+func (k *hashKeyDir) mutableShard(key string) *hashShard {
+	i := shardIndex(k.seed, key)
+	shard := k.shards[i]
+	if shard.gen != k.gen {
+		shard = &hashShard{kd: maps.Clone(shard.kd), gen: k.gen}
+		k.shards[i] = shard
+	}
+
+	return shard
+}
+
+func (k *hashKeyDir) set(key string, entry *Entry) {
+	k.mutableShard(key).kd[key] = entry
 }
 
-func (k *KeyDir) Set(key []byte, entry *Entry) {
+func (k *hashKeyDir) delete(key string) {
+	if _, ok := k.shards[shardIndex(k.seed, key)].kd[key]; !ok {
+		return
+	}
+
+	delete(k.mutableShard(key).kd, key)
+}
+
+func (k *hashKeyDir) Set(key []byte, entry *Entry) {
 	k.mu.Lock()
 	defer k.mu.Unlock()
 
-	k.kd[string(key)] = entry
+	k.set(string(key), entry)
+}
+
+func (k *hashKeyDir) Get(key []byte) (*Entry, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	entry, ok := k.shards[shardIndex(k.seed, string(key))].kd[string(key)]
+	if ok && entry.expired(time.Now().UnixNano()) {
+		return nil, false
+	}
+
+	return entry, ok
 }
 
-func (k *KeyDir) Get(key []byte) (*Entry, bool) {
+func (k *hashKeyDir) Lookup(key []byte) (*Entry, bool) {
 	k.mu.RLock()
 	defer k.mu.RUnlock()
 
-	entry, ok := k.kd[string(key)]
+	entry, ok := k.shards[shardIndex(k.seed, string(key))].kd[string(key)]
 	return entry, ok
 }
 
-func (k *KeyDir) Delete(key []byte) {
+func (k *hashKeyDir) Delete(key []byte) {
 	k.mu.Lock()
 	defer k.mu.Unlock()
 
-	delete(k.kd, string(key))
+	k.delete(string(key))
 }
 
-func (k *KeyDir) GetKeys() [][]byte {
+func (k *hashKeyDir) GetKeys() [][]byte {
 	k.mu.RLock()
 	defer k.mu.RUnlock()
 
-	keys := make([][]byte, 0, len(k.kd))
-	for key := range k.kd {
-		keys = append(keys, []byte(key))
+	length := 0
+	for _, shard := range k.shards {
+		length += len(shard.kd)
 	}
 
+	keys := make([][]byte, 0, length)
+	k.forEach(func(key []byte, entry *Entry) bool {
+		keys = append(keys, key)
+		return true
+	})
+
 	return keys
 }
 
-func (k *KeyDir) WarmUp(dirName string, filesName []string) error {
+func (k *hashKeyDir) Apply(keys [][]byte, entries []*Entry) {
 	k.mu.Lock()
 	defer k.mu.Unlock()
 
-	for _, fileName := range filesName {
-		filePath := path.Join(dirName, fileName)
-		data, err := os.ReadFile(filePath)
-		if err != nil {
-			return err
+	for idx, key := range keys {
+		if entries[idx] == nil {
+			k.delete(string(key))
+			continue
 		}
 
-		buf := bytes.NewBuffer(data)
-		offset := 0
+		k.set(string(key), entries[idx])
+	}
+}
+
+func (k *hashKeyDir) CompareAndSet(key []byte, old, entry *Entry) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	current, ok := k.shards[shardIndex(k.seed, string(key))].kd[string(key)]
+	if !ok || !sameEntry(current, old) {
+		return false
+	}
+
+	if entry == nil {
+		k.delete(string(key))
+	} else {
+		k.set(string(key), entry)
+	}
+	return true
+}
+
+func (k *hashKeyDir) ForEach(fn func(key []byte, entry *Entry) bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	k.forEach(fn)
+}
 
-		for buf.Len() > 0 {
-			// get checksum
-			checksum := bytesToUint32(buf.Next(checksumLen))
+func (k *hashKeyDir) Scan(fn func(key []byte, entry *Entry) bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
 
-			// get ts
-			ts := bytesToUint32(buf.Next(tsLen))
+	for _, shard := range k.shards {
+		for key, entry := range shard.kd {
+			if !fn([]byte(key), entry) {
+				return
+			}
+		}
+	}
+}
 
-			// get key size
-			keySize := bytesToUint32(buf.Next(keySizeLen))
+func (k *hashKeyDir) forEach(fn func(key []byte, entry *Entry) bool) {
+	now := time.Now().UnixNano()
 
-			// get value size
-			valueSize := bytesToUint64(buf.Next(valueSizeLen))
+	for _, shard := range k.shards {
+		for key, entry := range shard.kd {
+			if entry.expired(now) {
+				continue
+			}
 
-			// get key
-			key := buf.Next(int(keySize))
+			if !fn([]byte(key), entry) {
+				return
+			}
+		}
+	}
+}
 
-			// get value
-			val := buf.Next(int(valueSize))
+func (k *hashKeyDir) Snapshot() KeyDirSnapshot {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	// from now on every shard is shared with the snapshot
+	k.gen++
+	k.snapshots++
+
+	return &hashKeyDirSnapshot{
+		keyDir: k,
+		seed:   k.seed,
+		shards: k.shards,
+		now:    time.Now().UnixNano(),
+	}
+}
 
-			// encode data
-			data, err := encodeRawData(key, val, uint32ToBytes(ts))
+func (k *hashKeyDir) release() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.snapshots--
+	if k.snapshots > 0 {
+		return
+	}
+
+	// no snapshot shares the shards anymore, they can be modified in place
+	// again instead of being copied.
+	for _, shard := range k.shards {
+		shard.gen = k.gen
+	}
+}
+
+type hashKeyDirSnapshot struct {
+	keyDir   *hashKeyDir
+	seed     maphash.Seed
+	shards   [hashKeyDirShards]*hashShard
+	now      int64
+	released sync.Once
+}
+
+func (s *hashKeyDirSnapshot) Get(key []byte) (*Entry, bool) {
+	entry, ok := s.shards[shardIndex(s.seed, string(key))].kd[string(key)]
+	if ok && entry.expired(s.now) {
+		return nil, false
+	}
+
+	return entry, ok
+}
+
+func (s *hashKeyDirSnapshot) Cursor(start, end []byte, reverse bool) (KeyDirCursor, error) {
+	if reverse {
+		return nil, ErrIndexNotOrdered
+	}
+
+	return &hashKeyDirCursor{
+		snapshot: s,
+		start:    start,
+		end:      end,
+	}, nil
+}
+
+func (s *hashKeyDirSnapshot) Release() {
+	s.released.Do(s.keyDir.release)
+}
+
+// hashKeyDirCursor goes through the snapshot one shard at a time, so only the
+// keys of a single shard are held in memory.
+type hashKeyDirCursor struct {
+	snapshot *hashKeyDirSnapshot
+	start    []byte
+	end      []byte
+	shard    int
+	keys     []string
+	entries  []*Entry
+}
+
+func (c *hashKeyDirCursor) Next() ([]byte, *Entry, bool) {
+	for len(c.keys) == 0 {
+		if c.shard >= hashKeyDirShards {
+			return nil, nil, false
+		}
+
+		c.loadShard(c.snapshot.shards[c.shard])
+		c.shard++
+	}
+
+	key, entry := c.keys[0], c.entries[0]
+	c.keys, c.entries = c.keys[1:], c.entries[1:]
+
+	return []byte(key), entry, true
+}
+
+func (c *hashKeyDirCursor) loadShard(shard *hashShard) {
+	c.keys, c.entries = c.keys[:0], c.entries[:0]
+
+	for key, entry := range shard.kd {
+		if entry.expired(c.snapshot.now) {
+			continue
+		}
+		if c.start != nil && key < string(c.start) {
+			continue
+		}
+		if c.end != nil && key >= string(c.end) {
+			continue
+		}
+
+		c.keys = append(c.keys, key)
+		c.entries = append(c.entries, entry)
+	}
+}
+
+// warmUpDataFile loads the records of a data file into the key dir.
+// Corrupted records are handled according to opts.RecoveryMode; only the
+// newest data file, lastFile, is considered to possibly have a torn tail.
+func warmUpDataFile(keyDir KeyDir, dirName, fileName string, lastFile bool, now int64, opts *Option) error {
+	filePath := path.Join(dirName, fileName)
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	format, err := parseFileFormat(data)
+	if err != nil {
+		return &CorruptionError{FileID: fileName, Offset: 0, Err: err}
+	}
+	offset := format.offset
+
+	var pending *pendingBatch
+
+	for offset < len(data) {
+		diskEntry, n, err := format.decodeRecord(data[offset:])
+		if err != nil {
+			n, err = recoverRecord(filePath, format, data, offset, lastFile, err, opts)
 			if err != nil {
 				return err
 			}
 
-			if checksum != crc32.ChecksumIEEE(data) {
-				return ErrChecksumNotMatch
-			}
+			offset += n
+			continue
+		}
 
-			offset += checksumLen + tsLen + keySizeLen + valueSizeLen + int(keySize)
+		// a record that can't be decrypted isn't damaged, so it's never
+		// skipped: the key is missing or the record was tampered with
+		err = opts.keys.open(diskEntry)
+		if err != nil {
+			return &CorruptionError{FileID: fileName, Offset: offset, Err: err}
+		}
+		format.upgradeRecord(diskEntry)
 
-			k.kd[string(key)] = &Entry{
-				FileID:    fileName,
-				ValueSize: int(valueSize),
-				ValuePos:  offset,
-				Timestamp: ts,
+		switch {
+		case diskEntry.Flags&flagBatch != 0:
+			if pending == nil {
+				pending = &pendingBatch{offset: offset}
 			}
+			pending.add(diskEntry, offset, n)
+		case diskEntry.Type == recordBatchCommit:
+			if pending.committedBy(diskEntry) {
+				for i, batchEntry := range pending.diskEntries {
+					setDiskEntry(keyDir, fileName, format, batchEntry, pending.offsets[i], pending.sizes[i], now)
+				}
+			}
+			pending = nil
+		default:
+			pending = nil // the batch before this record was never committed
+			setDiskEntry(keyDir, fileName, format, diskEntry, offset, n, now)
+		}
 
-			offset += int(valueSize)
+		offset += n
+	}
+
+	// a crash in the middle of Batch.Commit leaves an uncommitted batch at
+	// the end of the newest data file, drop it like a torn record.
+	if pending != nil && lastFile {
+		err = dropUncommittedBatch(filePath, pending.offset, len(data), opts)
+		if err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
-func (k *KeyDir) Merge(k2 *KeyDir) {
-	k.mu.Lock()
-	defer k.mu.Unlock()
+// setDiskEntry points the key of diskEntry at the record of the given size
+// at offset in a file of the given format. The value of diskEntry may be
+// decrypted, so the size of the value on disk is taken from the size of the
+// record.
+func setDiskEntry(keyDir KeyDir, fileName string, format fileFormat, diskEntry *DiskEntry, offset, size int, now int64) {
+	if diskEntry.Type.isTombstone() || diskEntry.expired(now) {
+		keyDir.Delete(diskEntry.Key)
+		return
+	}
 
-	for key, entry := range k2.kd {
-		k.kd[string(key)] = entry
+	keyDir.Set(diskEntry.Key, &Entry{
+		FileID:    fileName,
+		ValueSize: size - format.headerLen() - len(diskEntry.Key),
+		ValuePos:  format.valuePos(diskEntry.Key, offset),
+		Timestamp: diskEntry.Ts,
+		Expiry:    diskEntry.Expiry,
+		seq:       nextSeq(),
+	})
+}
+
+func dropUncommittedBatch(filePath string, offset, size int, opts *Option) error {
+	if opts.ReadOnly {
+		opts.Logger.Printf("gobitcask: ignoring uncommitted batch at the end of %v at offset %v (%v bytes)",
+			filePath, offset, size-offset)
+		return nil
 	}
+
+	err := os.Truncate(filePath, int64(offset))
+	if err != nil {
+		return err
+	}
+
+	opts.Logger.Printf("gobitcask: truncated uncommitted batch at the end of %v at offset %v (%v bytes dropped)",
+		filePath, offset, size-offset)
+	return nil
 }
 
-func (k *KeyDir) GetKeyAndEntry() map[string]*Entry {
-	k.mu.RLock()
-	defer k.mu.RUnlock()
+// recoverRecord decides what to do with the corrupted record found at offset
+// and returns how many bytes to skip. A *CorruptionError is returned if the
+// corruption can't be recovered from.
+func recoverRecord(filePath string, format fileFormat, data []byte, offset int, lastFile bool, err error, opts *Option) (int, error) {
+	corruptionErr := &CorruptionError{FileID: path.Base(filePath), Offset: offset, Err: err}
+
+	if opts.RecoveryMode == RecoveryStrict {
+		return 0, corruptionErr
+	}
+
+	// only garbage follows a torn tail: a valid record after the corrupted
+	// one means the file was damaged rather than cut off by a crash
+	next := offset + nextRecord(format, data[offset:])
+	if lastFile && next == len(data) {
+		if opts.ReadOnly {
+			opts.Logger.Printf("gobitcask: ignoring torn tail of %v at offset %v (%v bytes): %v",
+				filePath, offset, len(data)-offset, err)
+			return len(data) - offset, nil
+		}
+
+		truncateErr := os.Truncate(filePath, int64(offset))
+		if truncateErr != nil {
+			return 0, truncateErr
+		}
+
+		opts.Logger.Printf("gobitcask: truncated torn tail of %v at offset %v (%v bytes dropped): %v",
+			filePath, offset, len(data)-offset, err)
+		return len(data) - offset, nil
+	}
+
+	if opts.RecoveryMode != RecoverySkipCorrupt {
+		return 0, corruptionErr
+	}
 
-	result := make(map[string]*Entry, len(k.kd))
-	for key, entry := range k.kd {
-		result[string(key)] = entry
+	if next < len(data) {
+		opts.Logger.Printf("gobitcask: skipped corrupted record of %v at offset %v (%v bytes): %v",
+			filePath, offset, next-offset, err)
+		return next - offset, nil
 	}
 
-	return result
+	opts.Logger.Printf("gobitcask: skipped rest of %v from offset %v (%v bytes): %v",
+		filePath, offset, len(data)-offset, err)
+	return len(data) - offset, nil
 }
@@ -0,0 +1,194 @@
+package gobitcask
+
+import (
+	"sync"
+	"time"
+)
+
+// btreeKeyDir is an OrderedKeyDir backed by a B-tree. Lookups cost
+// O(log n) instead of O(1), in exchange keys can be scanned in order.
+type btreeKeyDir struct {
+	tree *btree
+	mu   sync.RWMutex
+}
+
+func NewBTreeKeyDir() OrderedKeyDir {
+	return &btreeKeyDir{
+		tree: &btree{},
+	}
+}
+
+func (k *btreeKeyDir) Set(key []byte, entry *Entry) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.tree.set(string(key), entry)
+}
+
+func (k *btreeKeyDir) Get(key []byte) (*Entry, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	entry, ok := k.tree.get(string(key))
+	if ok && entry.expired(time.Now().UnixNano()) {
+		return nil, false
+	}
+
+	return entry, ok
+}
+
+func (k *btreeKeyDir) Lookup(key []byte) (*Entry, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.tree.get(string(key))
+}
+
+func (k *btreeKeyDir) Delete(key []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.tree.delete(string(key))
+}
+
+func (k *btreeKeyDir) GetKeys() [][]byte {
+	k.mu.RLock()
+	length := k.tree.length
+	k.mu.RUnlock()
+
+	keys := make([][]byte, 0, length)
+	k.ForEach(func(key []byte, entry *Entry) bool {
+		keys = append(keys, key)
+		return true
+	})
+
+	return keys
+}
+
+func (k *btreeKeyDir) Apply(keys [][]byte, entries []*Entry) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for idx, key := range keys {
+		if entries[idx] == nil {
+			k.tree.delete(string(key))
+			continue
+		}
+
+		k.tree.set(string(key), entries[idx])
+	}
+}
+
+func (k *btreeKeyDir) CompareAndSet(key []byte, old, entry *Entry) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	current, ok := k.tree.get(string(key))
+	if !ok || !sameEntry(current, old) {
+		return false
+	}
+
+	if entry == nil {
+		k.tree.delete(string(key))
+	} else {
+		k.tree.set(string(key), entry)
+	}
+	return true
+}
+
+func (k *btreeKeyDir) ForEach(fn func(key []byte, entry *Entry) bool) {
+	k.Ascend(nil, nil, fn)
+}
+
+func (k *btreeKeyDir) Scan(fn func(key []byte, entry *Entry) bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	k.tree.ascend(nil, nil, func(item btreeItem) bool {
+		return fn([]byte(item.key), item.entry)
+	})
+}
+
+func (k *btreeKeyDir) Ascend(start, end []byte, fn func(key []byte, entry *Entry) bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	now := time.Now().UnixNano()
+
+	k.tree.ascend(start, end, func(item btreeItem) bool {
+		if item.entry.expired(now) {
+			return true
+		}
+		return fn([]byte(item.key), item.entry)
+	})
+}
+
+func (k *btreeKeyDir) Descend(start, end []byte, fn func(key []byte, entry *Entry) bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	now := time.Now().UnixNano()
+
+	k.tree.descend(start, end, func(item btreeItem) bool {
+		if item.entry.expired(now) {
+			return true
+		}
+		return fn([]byte(item.key), item.entry)
+	})
+}
+
+func (k *btreeKeyDir) Snapshot() KeyDirSnapshot {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return &btreeKeyDirSnapshot{
+		tree: k.tree.clone(),
+		now:  time.Now().UnixNano(),
+	}
+}
+
+// btreeKeyDirSnapshot reads a clone of the tree, which nobody modifies, so it
+// needs no locking.
+type btreeKeyDirSnapshot struct {
+	tree *btree
+	now  int64
+}
+
+func (s *btreeKeyDirSnapshot) Get(key []byte) (*Entry, bool) {
+	entry, ok := s.tree.get(string(key))
+	if ok && entry.expired(s.now) {
+		return nil, false
+	}
+
+	return entry, ok
+}
+
+func (s *btreeKeyDirSnapshot) Cursor(start, end []byte, reverse bool) (KeyDirCursor, error) {
+	return &btreeKeyDirCursor{
+		cursor: s.tree.cursor(start, end, reverse),
+		now:    s.now,
+	}, nil
+}
+
+// Release is a no-op, the clone is simply left to the garbage collector.
+func (s *btreeKeyDirSnapshot) Release() {}
+
+type btreeKeyDirCursor struct {
+	cursor *btreeCursor
+	now    int64
+}
+
+func (c *btreeKeyDirCursor) Next() ([]byte, *Entry, bool) {
+	for {
+		item, ok := c.cursor.next()
+		if !ok {
+			return nil, nil, false
+		}
+
+		if item.entry.expired(c.now) {
+			continue
+		}
+
+		return []byte(item.key), item.entry, true
+	}
+}
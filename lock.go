@@ -0,0 +1,44 @@
+package gobitcask
+
+import (
+	"os"
+)
+
+// dirLock is an advisory lock on a database directory. It keeps two
+// processes from writing to the same directory at the same time.
+type dirLock struct {
+	f *os.File
+}
+
+// acquireLock locks the database directory. An exclusive lock is held by a
+// writer; several shared locks may be held at once as long as no exclusive
+// lock is held. ErrDatabaseLocked is returned if the lock is already taken.
+//
+// The directory itself is locked rather than a file in it, so that readers
+// don't create any file and can open a directory on a read-only mount.
+func acquireLock(dir string, shared bool) (*dirLock, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	err = lockFile(f, shared)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &dirLock{
+		f: f,
+	}, nil
+}
+
+func (l *dirLock) Release() error {
+	err := unlockFile(l.f)
+	if err != nil {
+		l.f.Close()
+		return err
+	}
+
+	return l.f.Close()
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package gobitcask
+
+import "os"
+
+// flock is not available on this platform, so the directory is not protected
+// against being opened by several processes.
+func lockFile(f *os.File, shared bool) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
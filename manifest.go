@@ -0,0 +1,239 @@
+package gobitcask
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"sort"
+)
+
+const (
+	manifestFilename = "MANIFEST"
+	manifestVersion  = 1
+	// formatVersion is the version of the layout of data, merge and hint
+	// files a database may hold, see fileVersion. Opening a database for
+	// writing raises its format version to this one.
+	formatVersion = 3
+)
+
+// manifest lists the files that make up the database. Files in the
+// directory that it doesn't list are ignored, which lets rotation and merge
+// publish their result with a single atomic rename of the manifest. File
+// names are sorted by ID.
+type manifest struct {
+	Version       int      `json:"version"`
+	FormatVersion int      `json:"format_version"`
+	ActiveID      int      `json:"active_id"`
+	DataFiles     []string `json:"data_files"` // including the active segment
+	MergeFiles    []string `json:"merge_files"`
+	HintFiles     []string `json:"hint_files"`
+}
+
+// openManifest loads the manifest of dirName. If there is none yet, or if
+// it's damaged and opts.Repair is set, it's rebuilt from the files in the
+// directory; the second return value is then true and the manifest must be
+// saved.
+func openManifest(dirName string, opts *Option) (*manifest, bool, error) {
+	m, err := loadManifest(dirName)
+	if err == nil {
+		err = m.check(dirName)
+	}
+	if err == nil {
+		return m, false, nil
+	}
+
+	missing := os.IsNotExist(err)
+	if !missing && !opts.Repair {
+		return nil, false, err
+	}
+
+	dirEntries, readErr := os.ReadDir(dirName)
+	if readErr != nil {
+		return nil, false, readErr
+	}
+
+	m = scanManifest(dirEntries)
+	if !missing {
+		opts.Logger.Printf("gobitcask: rebuilding %v of %v from the directory: %v", manifestFilename, dirName, err)
+	} else if len(m.DataFiles) > 0 {
+		opts.Logger.Printf("gobitcask: no %v in %v, building it from the directory", manifestFilename, dirName)
+	}
+
+	return m, true, nil
+}
+
+func loadManifest(dirName string) (*manifest, error) {
+	data, err := os.ReadFile(path.Join(dirName, manifestFilename))
+	if err != nil {
+		return nil, err
+	}
+
+	m := &manifest{}
+	err = json.Unmarshal(data, m)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidManifest, err)
+	}
+
+	if m.Version != manifestVersion {
+		return nil, fmt.Errorf("%w: unsupported version %v", ErrInvalidManifest, m.Version)
+	}
+	if m.FormatVersion > formatVersion {
+		return nil, fmt.Errorf("%w: unsupported format version %v", ErrInvalidManifest, m.FormatVersion)
+	}
+
+	return m, nil
+}
+
+// scanManifest builds a manifest from the files of the directory. The data
+// file with the highest ID is the active segment.
+func scanManifest(dirEntries []fs.DirEntry) *manifest {
+	m := &manifest{
+		Version:       manifestVersion,
+		FormatVersion: formatVersion,
+	}
+
+	for _, dirEntry := range dirEntries {
+		fileName := dirEntry.Name()
+		switch path.Ext(fileName) {
+		case ".data":
+			m.DataFiles = append(m.DataFiles, fileName)
+			if id := extractID(fileName); id > m.ActiveID {
+				m.ActiveID = id
+			}
+		case ".merge":
+			m.MergeFiles = append(m.MergeFiles, fileName)
+		case ".hint":
+			m.HintFiles = append(m.HintFiles, fileName)
+		}
+	}
+
+	for _, filesName := range [][]string{m.DataFiles, m.MergeFiles, m.HintFiles} {
+		sort.Slice(filesName, func(i, j int) bool {
+			return extractID(filesName[i]) < extractID(filesName[j])
+		})
+	}
+
+	return m
+}
+
+// removeLeftoverFiles removes the files of the directory the manifest doesn't
+// list: temporary files, the output of merges that didn't complete, the
+// inputs of merges that did, and segments created by a rotation that didn't
+// complete.
+func removeLeftoverFiles(dirName string, m *manifest, opts *Option) error {
+	dirEntries, err := os.ReadDir(dirName)
+	if err != nil {
+		return err
+	}
+
+	filesName := m.files()
+	for _, dirEntry := range dirEntries {
+		fileName := dirEntry.Name()
+		switch path.Ext(fileName) {
+		case ".data", ".merge", ".hint", ".tmp":
+		default:
+			continue
+		}
+
+		if slices.Contains(filesName, fileName) {
+			continue
+		}
+
+		err = os.Remove(path.Join(dirName, fileName))
+		if err != nil {
+			return err
+		}
+
+		opts.Logger.Printf("gobitcask: removed leftover file %v", path.Join(dirName, fileName))
+	}
+
+	return nil
+}
+
+// check makes sure that every file of the manifest exists.
+func (m *manifest) check(dirName string) error {
+	for _, fileName := range m.files() {
+		_, err := os.Stat(path.Join(dirName, fileName))
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: %v is missing", ErrInvalidManifest, fileName)
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// files returns the names of all the files of the manifest.
+func (m *manifest) files() []string {
+	filesName := make([]string, 0, len(m.DataFiles)+len(m.MergeFiles)+len(m.HintFiles))
+	filesName = append(filesName, m.DataFiles...)
+	filesName = append(filesName, m.MergeFiles...)
+	filesName = append(filesName, m.HintFiles...)
+
+	return filesName
+}
+
+func (m *manifest) clone() *manifest {
+	out := *m
+	out.DataFiles = append([]string(nil), m.DataFiles...)
+	out.MergeFiles = append([]string(nil), m.MergeFiles...)
+	out.HintFiles = append([]string(nil), m.HintFiles...)
+
+	return &out
+}
+
+// addDataFile makes fileName the active segment.
+func (m *manifest) addDataFile(fileName string) {
+	m.ActiveID = extractID(fileName)
+	if !slices.Contains(m.DataFiles, fileName) {
+		m.DataFiles = append(m.DataFiles, fileName)
+	}
+}
+
+// applyMerge replaces the merged data and merge files, and the hint files of
+// the latter, listed in removedFiles, by the new merge and hint files.
+func (m *manifest) applyMerge(removedFiles, mergeFiles, hintFiles []string) {
+	keep := func(filesName []string, added []string) []string {
+		kept := make([]string, 0, len(filesName)+len(added))
+		for _, fileName := range filesName {
+			if !slices.Contains(removedFiles, fileName) {
+				kept = append(kept, fileName)
+			}
+		}
+		kept = append(kept, added...)
+
+		sort.Slice(kept, func(i, j int) bool {
+			return extractID(kept[i]) < extractID(kept[j])
+		})
+		return kept
+	}
+
+	m.DataFiles = keep(m.DataFiles, nil)
+	m.MergeFiles = keep(m.MergeFiles, mergeFiles)
+	m.HintFiles = keep(m.HintFiles, hintFiles)
+}
+
+// save replaces the manifest on disk atomically.
+func (m *manifest) save(dirName string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path.Join(dirName, getTmpFilename(manifestFilename))
+	err = writeFileSync(tmpPath, data)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, path.Join(dirName, manifestFilename))
+	if err != nil {
+		return err
+	}
+
+	return syncDir(dirName)
+}
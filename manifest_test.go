@@ -0,0 +1,150 @@
+package gobitcask
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManifest(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	opts := []OptFn{
+		WithDirName(dirName),
+		WithSegmentSize(128), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	}
+
+	bc, err := New(opts...)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+
+	for i := 0; i < 20; i++ {
+		key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i)
+		err = bc.Put([]byte(key), []byte(val))
+		assert.Nil(t, err)
+	}
+
+	activeSegmentName := bc.activeSegment.GetID()
+	bc.Close()
+
+	m, err := loadManifest(dirName)
+	assert.Nil(t, err)
+	assert.Equal(t, extractID(activeSegmentName), m.ActiveID)
+	assert.Greater(t, len(m.DataFiles), 1)
+	assert.Equal(t, activeSegmentName, m.DataFiles[len(m.DataFiles)-1])
+
+	// files the manifest doesn't list are ignored and removed, even if they
+	// sort last
+	record, err := encode(&DiskEntry{Type: recordPut, Key: []byte("key0"), Value: []byte("garbage")})
+	assert.Nil(t, err)
+	garbage := append(fileHeader(), record...)
+	for _, fileName := range []string{getSegmentFilename(999), getMergeFilename(999)} {
+		err = os.WriteFile(path.Join(dirName, fileName), garbage, 0755)
+		assert.Nil(t, err)
+	}
+
+	bc, err = New(opts...)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+
+	assert.Equal(t, activeSegmentName, bc.activeSegment.GetID())
+	for i := 0; i < 20; i++ {
+		key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i)
+		fetchedVal, err := bc.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.EqualValues(t, val, fetchedVal)
+	}
+	bc.Close()
+
+	for _, fileName := range []string{getSegmentFilename(999), getMergeFilename(999)} {
+		_, err = os.Stat(path.Join(dirName, fileName))
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	// a database without a manifest is scanned, so the same file is now
+	// part of it
+	err = os.Remove(path.Join(dirName, manifestFilename))
+	assert.Nil(t, err)
+	err = os.WriteFile(path.Join(dirName, getSegmentFilename(999)), garbage, 0755)
+	assert.Nil(t, err)
+
+	bc, err = New(opts...)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+
+	assert.Equal(t, getSegmentFilename(999), bc.activeSegment.GetID())
+	fetchedVal, err := bc.Get([]byte("key0"))
+	assert.Nil(t, err)
+	assert.EqualValues(t, "garbage", fetchedVal)
+	bc.Close()
+
+	_, err = os.Stat(path.Join(dirName, manifestFilename))
+	assert.Nil(t, err)
+}
+
+func TestManifestRepair(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	opts := []OptFn{
+		WithDirName(dirName),
+		WithSegmentSize(128), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	}
+
+	bc, err := New(opts...)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+
+	for i := 0; i < 20; i++ {
+		key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i)
+		err = bc.Put([]byte(key), []byte(val))
+		assert.Nil(t, err)
+	}
+	bc.Close()
+
+	// a listed file is missing
+	err = os.Remove(path.Join(dirName, getSegmentFilename(0)))
+	assert.Nil(t, err)
+
+	_, err = New(opts...)
+	assert.True(t, errors.Is(err, ErrInvalidManifest))
+
+	bc, err = New(append(opts, WithRepair())...)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+	_, err = bc.Get([]byte("key19"))
+	assert.Nil(t, err)
+	bc.Close()
+
+	// the manifest itself is damaged
+	err = os.WriteFile(path.Join(dirName, manifestFilename), []byte("{"), 0755)
+	assert.Nil(t, err)
+
+	_, err = New(opts...)
+	assert.True(t, errors.Is(err, ErrInvalidManifest))
+
+	bc, err = New(append(opts, WithRepair())...)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+	_, err = bc.Get([]byte("key19"))
+	assert.Nil(t, err)
+	bc.Close()
+
+	// and was rewritten by the repair
+	bc, err = New(opts...)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+	bc.Close()
+}
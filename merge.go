@@ -1,9 +1,15 @@
 package gobitcask
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math"
 	"os"
 	"path"
+	"slices"
 	"sort"
 	"sync"
 	"time"
@@ -11,202 +17,1056 @@ import (
 
 type DiskEntry struct {
 	Checksum uint32
+	Type     recordType
+	Flags    byte // ID of the compressor of the value, 0 if it isn't compressed
 	Ts       uint32
+	Expiry   int64
 	Key      []byte
 	Value    []byte
 }
 
 type Merger struct {
+	db       *Bitcask
 	dir      string
-	keyDir   *KeyDir
+	keyDir   KeyDir
+	writeMu  sync.Locker // serializes merge results with the writers of the database
 	mergeOpt *MergeOption
-	stopCh   chan struct{}
-	wg       sync.WaitGroup
+	runCh    chan struct{} // holds a token while merging
+	limiter  *rateLimiter
+
+	pauseMu   sync.Mutex
+	resumeCh  chan struct{}           // closed when a paused merger is resumed, nil if it isn't paused
+	runCancel context.CancelCauseFunc // aborts the running merge, nil if none is running
+	preempts  int                     // number of callers of lockRunPreempting waiting
+
+	statusMu sync.Mutex
+	status   MergeStatus
+
+	// faultHook is called after each step of a merge, an error aborts the
+	// merge as if the process crashed. Only set in tests.
+	faultHook func(step mergeStep) error
+	ctx       context.Context // canceled by Stop
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+// MergeStatus reports on the merges run so far. Merges that find nothing to
+// merge don't count as a run.
+type MergeStatus struct {
+	LastRun      time.Time     // when the last merge started, zero if none ran yet
+	LastDuration time.Duration // how long the last merge took
+	LastError    error         // why the last merge failed, nil if it succeeded
+	// Failures is the number of merges that failed since the last one that
+	// succeeded.
+	Failures int
+	// BytesReclaimed is the size of the files the last successful merge
+	// removed minus the size of the merge files it wrote.
+	BytesReclaimed      int64
+	TotalBytesReclaimed int64
 }
 
-func NewMerger(dir string, keyDir *KeyDir, mergeOpt *MergeOption) *Merger {
+func NewMerger(db *Bitcask, mergeOpt *MergeOption) *Merger {
+	ctx, cancel := context.WithCancel(context.Background())
+
 	return &Merger{
-		dir:      dir,
-		keyDir:   keyDir,
+		db:       db,
+		dir:      db.option.DirName,
+		keyDir:   db.keyDir,
+		writeMu:  &db.mu,
 		mergeOpt: mergeOpt,
-		stopCh:   make(chan struct{}),
+		runCh:    make(chan struct{}, 1),
+		limiter:  newRateLimiter(mergeOpt.BytesPerSecond),
+		ctx:      ctx,
+		cancel:   cancel,
 	}
 }
 
+// Start runs the merger in the background until Stop is called.
 func (m *Merger) Start() {
 	m.wg.Add(1)
+	go m.run()
+}
+
+// run merges every MergeOption.Interval within MergeOption.Window. A failed
+// merge is reported to MergeOption.OnError and retried with an exponential
+// backoff; the database isn't affected by it and keeps working meanwhile.
+func (m *Merger) run() {
 	defer m.wg.Done()
 
-	ticker := time.NewTicker(m.mergeOpt.Interval)
+	timer := time.NewTimer(m.mergeOpt.Interval)
+	defer timer.Stop()
 
+	failures := 0
 	for {
 		select {
-		case <-ticker.C:
-			mergedFiles, lastSegmentName, err := m.getMergeFilesName()
-			if err == ErrNotEnoughDataFiles {
+		case <-timer.C:
+			wait := m.mergeOpt.Window.wait(time.Now())
+			if wait > 0 {
+				timer.Reset(wait)
 				continue
-			} else if err != nil {
-				panic(err) // TODO: should handle this error properly
 			}
 
-			mergedKeyDir, err := m.mergeData(mergedFiles, lastSegmentName)
-			if err != nil {
-				panic(err) // TODO: should handle this error properly
+			delay := m.mergeOpt.Interval
+			err := m.merge(m.ctx, false)
+			if err != nil && m.ctx.Err() != nil {
+				return
+			} else if err == ErrMergeAborted {
+				delay = m.mergeOpt.retryDelay(1)
+			} else if err != nil {
+				m.db.option.Logger.Printf("gobitcask: merge of %v failed: %v", m.dir, err)
+				if m.mergeOpt.OnError != nil {
+					m.mergeOpt.OnError(err)
+				}
+
+				failures++
+				delay = m.mergeOpt.retryDelay(failures)
+			} else {
+				failures = 0
 			}
+			timer.Reset(delay)
+
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
 
-			m.keyDir.Merge(mergedKeyDir)
+// Status returns the status of the merges run so far.
+func (m *Merger) Status() MergeStatus {
+	m.statusMu.Lock()
+	defer m.statusMu.Unlock()
 
-			err = m.createHintFile(lastSegmentName, mergedKeyDir)
-			if err != nil {
-				panic(err) // TODO: should handle this error properly
+	return m.status
+}
+
+// merge merges the files selected by planMerge, if there are enough of them,
+// and records the outcome in the status. It waits for a running merge to
+// complete first. Canceling ctx aborts the merge until it's published. A
+// paused merge is aborted with ErrMergeAborted, without recording it, when a
+// backup waits for it. If full is set, every file is merged, see planMerge.
+func (m *Merger) merge(ctx context.Context, full bool) error {
+	err := m.lockRun(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.unlockRun()
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	m.pauseMu.Lock()
+	m.runCancel = cancel
+	m.abortIfPreempted()
+	m.pauseMu.Unlock()
+
+	defer func() {
+		m.pauseMu.Lock()
+		m.runCancel = nil
+		m.pauseMu.Unlock()
+	}()
+
+	plan, err := m.planMerge(full)
+	if err == ErrNotEnoughDataFiles {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	reclaimed, err := m.mergeFiles(ctx, plan)
+	if err != nil && context.Cause(ctx) == ErrMergeAborted {
+		return ErrMergeAborted
+	}
+
+	m.statusMu.Lock()
+	m.status.LastRun = start
+	m.status.LastDuration = time.Since(start)
+	m.status.LastError = err
+	if err != nil {
+		m.status.Failures++
+	} else {
+		m.status.Failures = 0
+		m.status.BytesReclaimed = reclaimed
+		m.status.TotalBytesReclaimed += reclaimed
+	}
+	m.statusMu.Unlock()
+
+	return err
+}
+
+// mergeFiles replaces the files of plan by merge files holding only their
+// live records and returns the number of bytes reclaimed.
+func (m *Merger) mergeFiles(ctx context.Context, plan *mergePlan) (int64, error) {
+	outputs, err := m.mergeData(ctx, plan)
+	if err != nil {
+		return 0, err
+	}
+
+	err = m.afterStep(mergeStepWritten)
+	if err != nil {
+		return 0, err
+	}
+
+	mergeFiles := make([]string, 0, len(outputs))
+	hintFiles := make([]string, 0, len(outputs))
+	var mergeSize int64
+	for _, output := range outputs {
+		mergeFiles = append(mergeFiles, output.mergeFilename)
+		hintFiles = append(hintFiles, output.hintFilename)
+		mergeSize += output.size
+	}
+
+	for _, fileName := range append(slices.Clone(mergeFiles), hintFiles...) {
+		err = os.Rename(path.Join(m.dir, getTmpFilename(fileName)), path.Join(m.dir, fileName))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = syncDir(m.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	err = m.afterStep(mergeStepRenamed)
+	if err != nil {
+		return 0, err
+	}
+
+	// the merge is published by the manifest, the key dir is updated after
+	// it so that the merged files are unused from then on. A crash before
+	// this point leaves files New cleans up, a crash after it leaves merged
+	// files New removes.
+	m.writeMu.Lock()
+	manifest := m.db.manifest.clone()
+	manifest.applyMerge(plan.removedFiles, mergeFiles, hintFiles)
+	err = manifest.save(m.dir)
+	if err == nil {
+		m.db.manifest = manifest
+		for _, output := range outputs {
+			// publishing accounts for the records, the header is live too
+			stats := m.db.fileStats(output.mergeFilename)
+			stats.size = output.size
+			stats.live += int64(fileHeaderLen)
+		}
+	}
+	m.writeMu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	err = m.publish(plan.files, hintFiles)
+	if err != nil {
+		return 0, err
+	}
+
+	err = m.afterStep(mergeStepPublished)
+	if err != nil {
+		return 0, err
+	}
+
+	err = m.db.removeFiles(plan.removedFiles)
+	if err != nil {
+		return 0, err
+	}
+
+	return plan.size - mergeSize, nil
+}
+
+// publishBatchSize is the number of keys publish updates at a time while
+// holding the write lock.
+const publishBatchSize = 1024
+
+// publish points the keys of the merge files at them, streaming their hint
+// files. Only keys that still refer to one of the merged files are updated:
+// keys written or deleted while merging keep their newer entry.
+func (m *Merger) publish(mergedFiles, hintFiles []string) error {
+	merged := make(map[string]struct{}, len(mergedFiles))
+	for _, fileName := range mergedFiles {
+		merged[fileName] = struct{}{}
+	}
+
+	keys := make([][]byte, 0, publishBatchSize)
+	entries := make([]*Entry, 0, publishBatchSize)
+	apply := func() {
+		m.writeMu.Lock()
+		defer m.writeMu.Unlock()
+
+		for idx, key := range keys {
+			// keys that expired meanwhile are moved too, their entry is
+			// removed by the merge of the merge file
+			old, ok := m.keyDir.Lookup(key)
+			if !ok {
+				continue
 			}
 
-			for _, mergeFile := range mergedFiles {
-				mergeFilePath := path.Join(m.dir, mergeFile)
-				err = os.RemoveAll(mergeFilePath)
-				if err != nil {
-					panic(err) // TODO: should handle this error properly
-				}
+			if _, isMerged := merged[old.FileID]; !isMerged {
+				continue
 			}
 
-		case <-m.stopCh:
-			return
+			// the record only moved, versions taken before stay valid
+			entries[idx].seq = old.seq
+			if m.keyDir.CompareAndSet(key, old, entries[idx]) {
+				m.db.countEntry(key, old, -1)
+				m.db.countEntry(key, entries[idx], 1)
+			}
+		}
+
+		keys, entries = keys[:0], entries[:0]
+	}
+
+	for _, hintFilename := range hintFiles {
+		hint, err := OpenHint(m.dir, hintFilename)
+		if err != nil {
+			return err
+		}
+		hint.keys = m.db.option.keys
+
+		err = hint.ForEach(func(key []byte, entry *Entry) bool {
+			keys = append(keys, key)
+			entries = append(entries, entry)
+			if len(keys) == publishBatchSize {
+				apply()
+			}
+			return true
+		})
+		hint.f.Close()
+		if err != nil {
+			return err
 		}
 	}
+	apply()
+
+	m.writeMu.Lock()
+	for _, fileName := range mergedFiles {
+		delete(m.db.stats, fileName)
+	}
+	m.writeMu.Unlock()
+
+	return nil
+}
+
+// mergeStep is a point of a merge after which tests can inject a fault.
+type mergeStep int
+
+const (
+	mergeStepWritten   mergeStep = iota // merge and hint files are synced under temporary names
+	mergeStepRenamed                    // they are renamed, but not in the manifest yet
+	mergeStepPublished                  // the manifest lists them, the merged files are not removed yet
+)
+
+func (m *Merger) afterStep(step mergeStep) error {
+	if m.faultHook == nil {
+		return nil
+	}
+
+	return m.faultHook(step)
+}
+
+// lockRun waits for a running merge to finish and keeps new ones from
+// starting until unlockRun is called.
+func (m *Merger) lockRun(ctx context.Context) error {
+	select {
+	case m.runCh <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *Merger) unlockRun() {
+	<-m.runCh
+}
+
+// lockRunPreempting is lockRun, except that a paused merge is aborted instead
+// of waited for. Merges are only paused before they publish, so nothing they
+// did is visible yet and they can be retried later.
+func (m *Merger) lockRunPreempting() {
+	m.pauseMu.Lock()
+	m.preempts++
+	m.abortIfPreempted()
+	m.pauseMu.Unlock()
+
+	m.lockRun(context.Background())
+
+	m.pauseMu.Lock()
+	m.preempts--
+	m.pauseMu.Unlock()
+}
+
+// abortIfPreempted aborts the running merge if it's paused while someone
+// waits in lockRunPreempting. pauseMu must be held.
+func (m *Merger) abortIfPreempted() {
+	if m.resumeCh != nil && m.preempts > 0 && m.runCancel != nil {
+		m.runCancel(ErrMergeAborted)
+	}
+}
+
+// Pause holds a running merge at its next read or write, and merges started
+// later at their first one, until Resume is called. Nothing is lost, the
+// merge continues where it stopped.
+func (m *Merger) Pause() {
+	m.pauseMu.Lock()
+	defer m.pauseMu.Unlock()
+
+	if m.resumeCh == nil {
+		m.resumeCh = make(chan struct{})
+	}
+	m.abortIfPreempted()
+}
+
+func (m *Merger) Resume() {
+	m.pauseMu.Lock()
+	defer m.pauseMu.Unlock()
+
+	if m.resumeCh != nil {
+		close(m.resumeCh)
+		m.resumeCh = nil
+	}
+}
+
+// waitResumed waits until the merger isn't paused.
+func (m *Merger) waitResumed(ctx context.Context) error {
+	m.pauseMu.Lock()
+	resumeCh := m.resumeCh
+	m.pauseMu.Unlock()
+
+	if resumeCh == nil {
+		return nil
+	}
+
+	select {
+	case <-resumeCh:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
+// Stop stops the background merger, aborting a running merge.
 func (m *Merger) Stop() {
-	close(m.stopCh)
+	m.cancel()
 	m.wg.Wait()
 }
 
-func (m *Merger) getMergeFilesName() ([]string, string, error) {
-	dirEntries, err := os.ReadDir(m.dir)
-	if err != nil {
-		return nil, "", err
+// mergePlan describes a merge.
+type mergePlan struct {
+	// files are the data and merge files to merge, sorted by ID. They are
+	// split into groups, each of which is written to one merge file.
+	files  []string
+	groups [][]string
+	ids    []int // of the merge file of each group, that of its last file
+	size   int64 // of the files to merge
+
+	// removedFiles are the files to merge and the hint files of the merge
+	// files among them.
+	removedFiles []string
+
+	// oldestID is the ID of the oldest data or merge file that isn't
+	// merged. Tombstones are only needed in merge files newer than it.
+	oldestID int
+}
+
+// planMerge selects the files to merge: the data files but the active
+// segment and the merge files, whose garbage ratio is at least
+// MergeOption.GarbageRatio. Merge files without any garbage are never
+// merged. ErrNotEnoughDataFiles is returned if fewer than
+// MergeOption.MinFiles files are selected. If full is set, the active segment
+// is sealed first and every data and merge file is selected instead.
+//
+// The files are merged in ID order into merge files of about the segment
+// size. Each merge file is named after the newest file it copies records
+// from, so that it's loaded before any file holding a newer copy of one of
+// its keys. That file must be a data file: data file IDs are never reused,
+// so neither are the names of merge files, which may still be read from
+// after they are merged. Merge files are therefore merged together with the
+// next data file.
+func (m *Merger) planMerge(full bool) (*mergePlan, error) {
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+
+	if full {
+		// the sealed segment is newer than every merge file, so that all of
+		// them can be merged
+		err := m.db.rotate()
+		if err != nil {
+			return nil, err
+		}
 	}
-	dirEntries = dirEntries[:len(dirEntries)-1] // don't merge active segment
 
-	fileNameMap := make(map[string]bool)
-	for _, dirEntry := range dirEntries {
-		fileNameMap[dirEntry.Name()] = true
+	manifest := m.db.manifest
+	activeSegmentName := getSegmentFilename(manifest.ActiveID)
+	sealedFiles := slices.DeleteFunc(slices.Clone(manifest.DataFiles), func(fileName string) bool {
+		return fileName == activeSegmentName
+	})
+
+	now := time.Now()
+	plan := &mergePlan{}
+	var lastDataID int
+	for _, fileName := range sealedFiles {
+		if full || m.db.fileStats(fileName).garbageRatio(now) >= m.mergeOpt.GarbageRatio {
+			plan.files = append(plan.files, fileName)
+			lastDataID = extractID(fileName)
+		}
 	}
 
-	var lastSegmentName string
-	filesName := make([]string, 0)
+	var lastMergeID int
+	for _, fileName := range manifest.MergeFiles {
+		ratio := m.db.fileStats(fileName).garbageRatio(now)
+		if full || ratio > 0 && ratio >= m.mergeOpt.GarbageRatio {
+			plan.files = append(plan.files, fileName)
+			lastMergeID = extractID(fileName)
+		}
+	}
 
-	for idx, dirEntry := range dirEntries {
-		fileName := dirEntry.Name()
-		if idx == len(dirEntries)-1 {
-			lastSegmentName = fileName
+	if len(plan.files) > 0 && lastMergeID > lastDataID {
+		idx := slices.IndexFunc(sealedFiles, func(fileName string) bool {
+			return extractID(fileName) > lastMergeID
+		})
+		if idx >= 0 {
+			plan.files = append(plan.files, sealedFiles[idx])
+		} else {
+			// the merge files newer than every data file wait for the next
+			// merge
+			plan.files = slices.DeleteFunc(plan.files, func(fileName string) bool {
+				return path.Ext(fileName) == ".merge" && extractID(fileName) > lastDataID
+			})
 		}
+	}
 
-		// skip hint and merge files
-		fileExt := path.Ext(fileName)
-		if fileExt == ".hint" || fileExt == ".merge" {
-			continue
+	if len(plan.files) == 0 {
+		return nil, ErrNotEnoughDataFiles
+	}
+
+	if !full && m.mergeOpt.MinFiles != 0 && len(plan.files) < m.mergeOpt.MinFiles {
+		return nil, ErrNotEnoughDataFiles
+	}
+
+	sort.Slice(plan.files, func(i, j int) bool {
+		return extractID(plan.files[i]) < extractID(plan.files[j])
+	})
+
+	plan.oldestID = math.MaxInt
+	for _, fileName := range append(slices.Clone(manifest.DataFiles), manifest.MergeFiles...) {
+		if !slices.Contains(plan.files, fileName) {
+			plan.oldestID = min(plan.oldestID, extractID(fileName))
+		}
+	}
+
+	var group []string
+	var groupSize int64
+	for _, fileName := range plan.files {
+		stats := m.db.fileStats(fileName)
+		plan.size += stats.size
+
+		plan.removedFiles = append(plan.removedFiles, fileName)
+		if path.Ext(fileName) == ".merge" {
+			plan.removedFiles = append(plan.removedFiles, getHintFilename(extractID(fileName)))
 		}
 
-		filesName = append(filesName, fileName)
+		live := stats.liveSize(now)
+		full := len(group) > 0 && groupSize+live > int64(m.db.option.SegmentSize)
+		if full && path.Ext(group[len(group)-1]) == ".data" {
+			plan.groups = append(plan.groups, group)
+			group, groupSize = nil, 0
+		}
+		group = append(group, fileName)
+		groupSize += live
 	}
+	plan.groups = append(plan.groups, group)
 
-	if m.mergeOpt.MinFiles != 0 && len(filesName) < m.mergeOpt.MinFiles {
-		return nil, "", ErrNotEnoughDataFiles
+	for _, group := range plan.groups {
+		plan.ids = append(plan.ids, extractID(group[len(group)-1]))
 	}
 
-	return filesName, lastSegmentName, nil
+	return plan, nil
+}
+
+// mergeOutput is a merge file written by a merge, along with its hint file.
+type mergeOutput struct {
+	mergeFilename string
+	hintFilename  string
+	size          int64
 }
 
-func (m *Merger) mergeData(filesName []string, lastSegmentName string) (*KeyDir, error) {
-	keyDir := NewKeyDir()
+// mergeData copies the records of the files of plan that the key dir still
+// refers to into merge files, and writes their hint files, all under
+// temporary names. Records are streamed through buffers of
+// MergeOption.BufferSize, so memory use doesn't grow with the size of the
+// data. Up to MergeOption.Concurrency groups are merged at once, all of them
+// sharing the I/O budget of MergeOption.BytesPerSecond. Groups without any
+// live record don't produce a merge file.
+func (m *Merger) mergeData(ctx context.Context, plan *mergePlan) ([]mergeOutput, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	t := &throttle{ctx: ctx, m: m}
+	results := make([]*mergeOutput, len(plan.groups))
+	sem := make(chan struct{}, m.mergeOpt.concurrency())
+
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+	for idx := range plan.groups {
+		sem <- struct{}{}
+		wg.Add(1)
+
+		go func(idx int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			keepTombstones := plan.oldestID < plan.ids[idx]
+			output, err := m.mergeGroup(t, plan.groups[idx], plan.ids[idx], keepTombstones)
+			if err != nil {
+				// the first error makes the others give up
+				errOnce.Do(func() {
+					firstErr = err
+					cancel()
+				})
+				return
+			}
+			results[idx] = output
+		}(idx)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	outputs := make([]mergeOutput, 0, len(results))
+	for _, output := range results {
+		if output != nil {
+			outputs = append(outputs, *output)
+		}
+	}
+
+	return outputs, nil
+}
+
+// mergeGroup merges the given files into the merge file of the given ID. It
+// returns nil if none of their records is live or kept. Tombstones are only
+// kept if keepTombstones is true, see mergeFile.
+func (m *Merger) mergeGroup(t *throttle, filesName []string, id int, keepTombstones bool) (*mergeOutput, error) {
+	w := &mergeWriter{
+		dir:        m.dir,
+		bufferSize: m.mergeOpt.bufferSize(),
+		id:         id,
+		throttle:   t,
+		keys:       m.db.option.keys,
+	}
 
-	diskEntryMap := make(map[string]*DiskEntry)
 	for _, fileName := range filesName {
-		filePath := path.Join(m.dir, fileName)
-		data, err := os.ReadFile(filePath)
+		err := m.mergeFile(t, w, fileName, keepTombstones)
 		if err != nil {
+			w.abort()
 			return nil, err
 		}
+	}
 
-		buf := bytes.NewBuffer(data)
-		for buf.Len() > 0 {
-			// get checksum
-			checksum := bytesToUint32(buf.Next(checksumLen))
+	err := w.close()
+	if err != nil {
+		w.abort()
+		return nil, err
+	}
 
-			// get ts
-			ts := bytesToUint32(buf.Next(tsLen))
+	if w.mergeBuf == nil {
+		return nil, nil
+	}
 
-			// get key size
-			keySize := bytesToUint32(buf.Next(keySizeLen))
+	return &mergeOutput{
+		mergeFilename: getMergeFilename(id),
+		hintFilename:  getHintFilename(id),
+		size:          int64(w.offset),
+	}, nil
+}
 
-			// get value size
-			valueSize := bytesToUint64(buf.Next(valueSizeLen))
+// mergeFile copies the live records of fileName to w. If keepTombstones is
+// true, older files that aren't merged may still hold values of the keys
+// fileName deleted, so the tombstones of keys that are still deleted are
+// copied too; expired values are replaced with tombstones for the same
+// reason. Otherwise tombstones are dropped.
+func (m *Merger) mergeFile(t *throttle, w *mergeWriter, fileName string, keepTombstones bool) error {
+	f, err := os.Open(path.Join(m.dir, fileName))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
 
-			// get key
-			key := buf.Next(int(keySize))
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
 
-			// get value
-			val := buf.Next(int(valueSize))
+	r, err := newRecordReader(&throttledReader{r: f, t: t}, int(info.Size()), w.bufferSize)
+	if err != nil {
+		return &CorruptionError{FileID: fileName, Offset: 0, Err: err}
+	}
 
-			// key/value pair is deleted
-			if bytes.Equal(val, tombstoneValue) {
-				continue
+	// the tombstones of a batch are only kept once its commit record is
+	// read; batches that were never committed didn't delete anything
+	var pending *pendingBatch
+
+	now := time.Now().UnixNano()
+	for {
+		err = t.ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		diskEntry, offset, err := r.next()
+		if err == io.EOF {
+			return nil
+		} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return err
+		} else if err != nil {
+			return &CorruptionError{FileID: fileName, Offset: offset, Err: err}
+		}
+
+		err = m.db.option.keys.open(diskEntry)
+		if err != nil {
+			return &CorruptionError{FileID: fileName, Offset: offset, Err: err}
+		}
+		r.format.upgradeRecord(diskEntry)
+
+		if diskEntry.Type == recordBatchCommit {
+			if pending.committedBy(diskEntry) {
+				for _, tombstone := range pending.diskEntries {
+					if tombstone == nil {
+						continue
+					}
+
+					err = w.write(tombstone)
+					if err != nil {
+						return err
+					}
+				}
+			}
+			pending = nil
+			continue
+		}
+
+		inBatch := diskEntry.Flags&flagBatch != 0
+		if !inBatch {
+			pending = nil // the batch before this record was never committed
+		} else if pending == nil {
+			pending = &pendingBatch{}
+		}
+
+		// the key dir only refers to the latest committed value of a key:
+		// anything else is overwritten, deleted or part of a batch that was
+		// never committed. Expired values are dropped, and their entry too.
+		entry, ok := m.keyDir.Lookup(diskEntry.Key)
+		live := ok && entry.FileID == fileName && entry.ValuePos == r.format.valuePos(diskEntry.Key, offset)
+		if ok && entry.expired(now) {
+			if live {
+				m.removeExpired(diskEntry.Key, entry)
+			}
+			live, ok = false, false
+		}
+		if !live {
+			var tombstone *DiskEntry
+			if keepTombstones && !ok {
+				tombstone = newTombstone(diskEntry, now)
+			}
+
+			if inBatch {
+				pending.add(tombstone, offset, 0)
+			} else if tombstone != nil {
+				err = w.write(tombstone)
+				if err != nil {
+					return err
+				}
 			}
+			continue
+		}
+		if inBatch {
+			pending.add(nil, offset, 0)
+		}
 
-			diskEntryMap[string(key)] = &DiskEntry{
-				Checksum: checksum,
-				Ts:       ts,
-				Key:      key,
-				Value:    val,
+		// values written before compression was enabled are compressed now
+		val, flags := diskEntry.Value, diskEntry.Flags&^flagBatch
+		if flags&flagCompressorMask == 0 {
+			val, flags, err = m.db.option.compressValue(val)
+			if err != nil {
+				return err
 			}
 		}
+
+		err = w.write(&DiskEntry{
+			Type:   recordPut,
+			Flags:  flags,
+			Ts:     diskEntry.Ts,
+			Expiry: diskEntry.Expiry,
+			Key:    diskEntry.Key,
+			Value:  val,
+		})
+		if err != nil {
+			return err
+		}
 	}
+}
 
-	diskEntries := make([]*DiskEntry, 0, len(diskEntryMap))
-	for _, diskEntry := range diskEntryMap {
-		diskEntries = append(diskEntries, diskEntry)
+// removeExpired removes the expired entry of key from the key dir, unless
+// the key was written meanwhile. The record is dropped by the merge, so the
+// entry would point at a removed file otherwise.
+func (m *Merger) removeExpired(key []byte, entry *Entry) {
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+
+	if m.keyDir.CompareAndSet(key, entry, nil) {
+		m.db.countEntry(key, entry, -1)
 	}
+}
 
-	sort.Slice(diskEntries, func(i, j int) bool {
-		return diskEntries[i].Ts < diskEntries[j].Ts
-	})
+// newTombstone returns the tombstone a merge keeps in place of diskEntry,
+// which the key dir doesn't refer to: diskEntry itself if it's a tombstone,
+// a recordExpiry if its value expired, nil otherwise. The key is copied
+// since the reader reuses its buffer.
+func newTombstone(diskEntry *DiskEntry, now int64) *DiskEntry {
+	recordType := diskEntry.Type
+	if !recordType.isTombstone() {
+		if !diskEntry.expired(now) {
+			return nil
+		}
+		recordType = recordExpiry
+	}
 
-	mergeFilename := getMergeFilename(extractID(lastSegmentName))
-	mergeSegment, err := NewSegment(m.dir, mergeFilename)
+	return &DiskEntry{
+		Type: recordType,
+		Ts:   diskEntry.Ts,
+		Key:  bytes.Clone(diskEntry.Key),
+	}
+}
+
+// mergeWriter writes a merge file and its hint file under temporary names.
+// The files are created with the first record.
+type mergeWriter struct {
+	dir        string
+	bufferSize int
+	id         int
+	throttle   *throttle
+	keys       *keyRing
+
+	mergeFile *os.File
+	mergeBuf  *bufio.Writer
+	hintFile  *os.File
+	hintBuf   *bufio.Writer
+	offset    int
+}
+
+// write appends a record to the merge file and its entry to the hint file.
+// Records are re-encrypted with the current key, so that older keys can be
+// retired once all the files using them are merged.
+func (w *mergeWriter) write(diskEntry *DiskEntry) error {
+	key := diskEntry.Key
+	err := w.keys.seal(diskEntry)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	data, err := encode(diskEntry)
+	if err != nil {
+		return err
 	}
 
-	for _, diskEntry := range diskEntries {
-		data, err := encode(diskEntry.Key, diskEntry.Value, uint32ToBytes(diskEntry.Ts))
+	if w.mergeBuf == nil {
+		err = w.create()
 		if err != nil {
-			return nil, err
+			return err
 		}
+	}
+
+	_, err = w.mergeBuf.Write(data)
+	if err != nil {
+		return err
+	}
+
+	rawHint, err := encodeRawHint(key, &Entry{
+		ValueSize: len(diskEntry.Value),
+		ValuePos:  getValuePos(key, w.offset),
+		Timestamp: diskEntry.Ts,
+		Expiry:    diskEntry.Expiry,
+	}, diskEntry.Type.isTombstone(), w.keys)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.hintBuf.Write(rawHint)
+	if err != nil {
+		return err
+	}
 
-		offset, err := mergeSegment.GetOffset()
+	w.offset += len(data)
+	return nil
+}
+
+// create creates the merge and hint files. Files under their names that
+// aren't in the manifest are leftovers of a merge that didn't complete.
+func (w *mergeWriter) create() error {
+	mergeFilename, hintFilename := getMergeFilename(w.id), getHintFilename(w.id)
+	for _, fileName := range []string{mergeFilename, hintFilename} {
+		for _, name := range []string{fileName, getTmpFilename(fileName)} {
+			err := os.RemoveAll(path.Join(w.dir, name))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	var err error
+	w.mergeFile, err = os.OpenFile(path.Join(w.dir, getTmpFilename(mergeFilename)), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0755)
+	if err != nil {
+		return err
+	}
+
+	w.hintFile, err = os.OpenFile(path.Join(w.dir, getTmpFilename(hintFilename)), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0755)
+	if err != nil {
+		return err
+	}
+
+	w.mergeBuf = bufio.NewWriterSize(&throttledWriter{w: w.mergeFile, t: w.throttle}, w.bufferSize)
+	w.hintBuf = bufio.NewWriterSize(&throttledWriter{w: w.hintFile, t: w.throttle}, w.bufferSize)
+
+	for _, buf := range []*bufio.Writer{w.mergeBuf, w.hintBuf} {
+		_, err = buf.Write(fileHeader())
 		if err != nil {
-			return nil, err
+			return err
 		}
+	}
+	w.offset = fileHeaderLen
+
+	return nil
+}
 
-		err = mergeSegment.Write(offset, data)
+// close flushes, syncs and closes the merge and hint files.
+func (w *mergeWriter) close() error {
+	for _, out := range []struct {
+		f   **os.File
+		buf *bufio.Writer
+	}{
+		{&w.mergeFile, w.mergeBuf},
+		{&w.hintFile, w.hintBuf},
+	} {
+		if *out.f == nil {
+			continue
+		}
+
+		err := out.buf.Flush()
 		if err != nil {
-			return nil, err
+			return err
 		}
+
+		err = (*out.f).Sync()
+		if err != nil {
+			return err
+		}
+
+		err = (*out.f).Close()
+		*out.f = nil
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// abort closes the files after a failure. The temporary files are left for
+// the next merge or New to remove.
+func (w *mergeWriter) abort() {
+	for _, f := range []*os.File{w.mergeFile, w.hintFile} {
+		if f != nil {
+			f.Close()
+		}
+	}
+	w.mergeFile, w.hintFile = nil, nil
+}
+
+// recordReader reads the records of a data file one after another through a
+// buffer instead of loading the whole file.
+type recordReader struct {
+	r      *bufio.Reader
+	size   int
+	offset int
+	buf    []byte
+	format fileFormat
+}
+
+// newRecordReader returns a reader of the records of the file of the given
+// size that r reads from the start, once it read the header of the file.
+func newRecordReader(r io.Reader, size, bufferSize int) (*recordReader, error) {
+	rr := &recordReader{
+		r:    bufio.NewReaderSize(r, bufferSize),
+		size: size,
+	}
+
+	header, err := rr.r.Peek(min(fileHeaderLen, size))
+	if err != nil {
+		return nil, err
 	}
 
-	err = keyDir.WarmUp(m.dir, []string{mergeFilename})
+	rr.format, err = parseFileFormat(header)
 	if err != nil {
 		return nil, err
 	}
 
-	return keyDir, nil
+	rr.offset = min(rr.format.offset, size)
+	_, err = rr.r.Discard(rr.offset)
+	if err != nil {
+		return nil, err
+	}
+
+	return rr, nil
 }
 
-func (m *Merger) createHintFile(id string, keyDir *KeyDir) error {
-	hint, err := NewHint(m.dir, getHintFilename(extractID(id)))
+// next returns the next record and its offset, or io.EOF once the end of the
+// file is reached. The record is only valid until the next call.
+func (rr *recordReader) next() (*DiskEntry, int, error) {
+	offset := rr.offset
+	if offset >= rr.size {
+		return nil, offset, io.EOF
+	}
+
+	headerLen := rr.format.headerLen()
+	if cap(rr.buf) < headerLen {
+		rr.buf = make([]byte, headerLen)
+	}
+
+	_, err := io.ReadFull(rr.r, rr.buf[:headerLen])
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, offset, ErrIncompleteRecord
+	} else if err != nil {
+		return nil, offset, err
+	}
+
+	keySize, valueSize := rr.format.recordSizes(rr.buf)
+	remaining := uint64(rr.size - offset - headerLen)
+	if keySize > remaining || valueSize > remaining-keySize {
+		return nil, offset, ErrIncompleteRecord
+	}
+
+	n := headerLen + int(keySize) + int(valueSize)
+	if cap(rr.buf) < n {
+		rr.buf = append(rr.buf[:headerLen], make([]byte, n-headerLen)...)
+	}
+
+	_, err = io.ReadFull(rr.r, rr.buf[headerLen:n])
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, offset, ErrIncompleteRecord
+	} else if err != nil {
+		return nil, offset, err
+	}
+
+	diskEntry, _, err := rr.format.decodeRecord(rr.buf[:n])
 	if err != nil {
-		return err
+		return nil, offset, err
 	}
 
-	return hint.Write(keyDir)
+	rr.offset += n
+	return diskEntry, offset, nil
+}
+
+func (d *DiskEntry) expired(now int64) bool {
+	return d.Expiry != 0 && d.Expiry <= now
 }
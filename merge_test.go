@@ -1,8 +1,12 @@
 package gobitcask
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"path"
+	"strings"
 	"testing"
 	"time"
 
@@ -22,6 +26,7 @@ func TestMergeData(t *testing.T) {
 	)
 	assert.Nil(t, err)
 	assert.NotNil(t, bc)
+	defer bc.Close()
 
 	for i := 0; i < 100; i++ {
 		key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i)
@@ -39,6 +44,54 @@ func TestMergeData(t *testing.T) {
 	}
 }
 
+func TestMergeClosesRemovedSegments(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	bc, err := New(
+		WithDirName(dirName),
+		WithSegmentSize(128), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+	defer bc.Close()
+
+	// only the segments of files in the manifest stay open
+	checkSegments := func() {
+		bc.segmentsMu.RLock()
+		defer bc.segmentsMu.RUnlock()
+
+		files := append(bc.manifest.DataFiles, bc.manifest.MergeFiles...)
+		for fileID := range bc.openedSegments {
+			assert.Contains(t, files, fileID)
+		}
+	}
+
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 20; i++ {
+			key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v-%v", i, round)
+			err = bc.Put([]byte(key), []byte(val))
+			assert.Nil(t, err)
+
+			fetchedVal, err := bc.Get([]byte(key))
+			assert.Nil(t, err)
+			assert.EqualValues(t, val, fetchedVal)
+		}
+
+		// files removed while an iterator is open are closed with it
+		it := bc.Iterator()
+		err = bc.Merge(context.Background())
+		assert.Nil(t, err)
+
+		err = it.Close()
+		assert.Nil(t, err)
+		checkSegments()
+	}
+}
+
 func TestSkipHintAndMergeFile(t *testing.T) {
 	dirName := "./test"
 	defer os.RemoveAll(dirName)
@@ -83,6 +136,7 @@ func TestSkipHintAndMergeFile(t *testing.T) {
 	)
 	assert.Nil(t, err)
 	assert.NotNil(t, bc2)
+	defer bc2.Close()
 
 	for i := 0; i < 100; i++ {
 		key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i)
@@ -96,3 +150,779 @@ func TestSkipHintAndMergeFile(t *testing.T) {
 		assert.EqualValues(t, val, fetchedVal)
 	}
 }
+
+func TestMergeDropsExpiredKeys(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	bc, err := New(
+		WithDirName(dirName),
+		WithSegmentSize(128), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+	defer bc.Close()
+
+	for i := 0; i < 10; i++ {
+		key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i)
+		err = bc.PutWithTTL([]byte(key), []byte(val), 50*time.Millisecond)
+		assert.Nil(t, err)
+
+		key, val = fmt.Sprintf("newkey%v", i), fmt.Sprintf("newval%v", i)
+		err = bc.Put([]byte(key), []byte(val))
+		assert.Nil(t, err)
+	}
+
+	<-time.After(100 * time.Millisecond)
+
+	// rotate, so that every expired key gets merged
+	err = bc.Put([]byte("filler"), make([]byte, 100))
+	assert.Nil(t, err)
+
+	err = bc.Merge(context.Background())
+	assert.Nil(t, err)
+
+	// the entries of the expired keys are removed, not only hidden
+	entries := 0
+	for i := 0; i < 10; i++ {
+		_, ok := bc.keyDir.Lookup([]byte(fmt.Sprintf("key%v", i)))
+		assert.False(t, ok)
+
+		_, ok = bc.keyDir.Lookup([]byte(fmt.Sprintf("newkey%v", i)))
+		if ok {
+			entries++
+		}
+	}
+	assert.Equal(t, 10, entries)
+	assert.Len(t, bc.keyDir.GetKeys(), 11)
+
+	mergedKeys := 0
+	for _, hintFilename := range bc.manifest.HintFiles {
+		hint, err := OpenHint(dirName, hintFilename)
+		assert.Nil(t, err)
+
+		err = hint.ForEach(func(key []byte, entry *Entry) bool {
+			assert.False(t, strings.HasPrefix(string(key), "key"), "expired keys are dropped")
+			mergedKeys++
+			return true
+		})
+		assert.Nil(t, err)
+		hint.Close()
+	}
+	assert.NotZero(t, mergedKeys)
+}
+
+func TestMergeSplitsOutput(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	opts := []OptFn{
+		WithDirName(dirName),
+		WithSegmentSize(128), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval:   6 * time.Hour,
+			BufferSize: 16, // bytes, smaller than a record
+		}),
+	}
+
+	bc, err := New(opts...)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 50; i++ {
+			key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v-%v", i, round)
+			err = bc.Put([]byte(key), []byte(val))
+			assert.Nil(t, err)
+		}
+	}
+	for i := 0; i < 50; i += 2 {
+		err = bc.Delete([]byte(fmt.Sprintf("key%v", i)))
+		assert.Nil(t, err)
+	}
+
+	// rotate, so that every key under test gets merged
+	err = bc.Put([]byte("filler"), make([]byte, 100))
+	assert.Nil(t, err)
+
+	err = bc.Merge(context.Background())
+	assert.Nil(t, err)
+
+	assert.Greater(t, len(bc.manifest.MergeFiles), 1)
+	assert.Equal(t, len(bc.manifest.MergeFiles), len(bc.manifest.HintFiles))
+	for _, mergeFilename := range bc.manifest.MergeFiles {
+		info, err := os.Stat(path.Join(dirName, mergeFilename))
+		assert.Nil(t, err)
+		assert.LessOrEqual(t, info.Size(), int64(128))
+	}
+
+	check := func() {
+		for i := 0; i < 50; i++ {
+			fetchedVal, err := bc.Get([]byte(fmt.Sprintf("key%v", i)))
+			if i%2 == 0 {
+				assert.Equal(t, ErrKeyNotFound, err)
+				continue
+			}
+			assert.Nil(t, err)
+			assert.EqualValues(t, fmt.Sprintf("val%v-2", i), fetchedVal)
+		}
+	}
+	check()
+
+	err = bc.Close()
+	assert.Nil(t, err)
+
+	bc, err = New(opts...)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+	defer bc.Close()
+
+	check()
+}
+
+func TestMergeKeepsConcurrentWrites(t *testing.T) {
+	for _, index := range []IndexType{HashIndex, BTreeIndex} {
+		dirName := "./test"
+
+		bc, err := New(
+			WithDirName(dirName),
+			WithSegmentSize(128), // bytes
+			WithIndex(index),
+			WithMergeOpt(&MergeOption{
+				Interval: 6 * time.Hour,
+			}),
+		)
+		assert.Nil(t, err)
+		assert.NotNil(t, bc)
+
+		for i := 0; i < 30; i++ {
+			key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i)
+			err = bc.Put([]byte(key), []byte(val))
+			assert.Nil(t, err)
+		}
+
+		// rotate, so that every key under test gets merged
+		err = bc.Put([]byte("filler"), make([]byte, 100))
+		assert.Nil(t, err)
+
+		// overwrite and delete keys after the merge read them, but before it
+		// publishes its result
+		bc.merger.faultHook = func(step mergeStep) error {
+			if step != mergeStepWritten {
+				return nil
+			}
+
+			for i := 0; i < 30; i += 3 {
+				err := bc.Put([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("new%v", i)))
+				assert.Nil(t, err)
+				err = bc.Delete([]byte(fmt.Sprintf("key%v", i+1)))
+				assert.Nil(t, err)
+			}
+			return nil
+		}
+		err = bc.Merge(context.Background())
+		assert.Nil(t, err)
+
+		for i := 0; i < 30; i++ {
+			key := fmt.Sprintf("key%v", i)
+			fetchedVal, err := bc.Get([]byte(key))
+			switch i % 3 {
+			case 0:
+				assert.Nil(t, err)
+				assert.EqualValues(t, fmt.Sprintf("new%v", i), fetchedVal)
+			case 1:
+				assert.Equal(t, ErrKeyNotFound, err)
+			default:
+				assert.Nil(t, err)
+				assert.EqualValues(t, fmt.Sprintf("val%v", i), fetchedVal)
+
+				// untouched keys are served by the merge file
+				_, entry, err := bc.GetWithVersion([]byte(key))
+				assert.Nil(t, err)
+				assert.Equal(t, getMergeFilename(extractID(entry.FileID)), entry.FileID)
+			}
+		}
+
+		bc.Close()
+		os.RemoveAll(dirName)
+	}
+}
+
+func TestInvalidMergeOption(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	for _, opt := range []OptFn{WithMergeOpt(nil), WithMergeOpt(&MergeOption{}), WithMergeOpt(&MergeOption{Interval: -time.Second})} {
+		_, err := New(WithDirName(dirName), opt)
+		assert.ErrorIs(t, err, ErrInvalidOption)
+	}
+
+	// a read-only database doesn't merge
+	bc, err := New(
+		WithDirName(dirName),
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	)
+	assert.Nil(t, err)
+	err = bc.Close()
+	assert.Nil(t, err)
+
+	ro, err := New(WithDirName(dirName), WithReadOnly())
+	assert.Nil(t, err)
+	err = ro.Close()
+	assert.Nil(t, err)
+}
+
+func TestMergeErrorsAreRetried(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	errDisk := errors.New("disk error")
+	errCh := make(chan error, 10)
+
+	bc, err := New(
+		WithDirName(dirName),
+		WithSegmentSize(128), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval:     50 * time.Millisecond,
+			RetryBackoff: 10 * time.Millisecond,
+			OnError: func(err error) {
+				errCh <- err
+			},
+		}),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+	defer bc.Close()
+
+	assert.Equal(t, MergeStatus{}, bc.MergeStatus())
+
+	// the first merges fail, the retries succeed
+	failures := 2
+	bc.merger.lockRun(context.Background())
+	bc.merger.faultHook = func(step mergeStep) error {
+		if step != mergeStepWritten || failures == 0 {
+			return nil
+		}
+		failures--
+		return errDisk
+	}
+	bc.merger.unlockRun()
+
+	for i := 0; i < 30; i++ {
+		key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i)
+		err = bc.Put([]byte(key), []byte(val))
+		assert.Nil(t, err)
+	}
+
+	select {
+	case err := <-errCh:
+		assert.Equal(t, errDisk, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("merge error not reported")
+	}
+
+	// the database keeps working
+	err = bc.Put([]byte("key0"), []byte("new0"))
+	assert.Nil(t, err)
+	fetchedVal, err := bc.Get([]byte("key0"))
+	assert.Nil(t, err)
+	assert.EqualValues(t, "new0", fetchedVal)
+
+	// and the merge is retried until it succeeds
+	assert.Eventually(t, func() bool {
+		status := bc.MergeStatus()
+		return status.LastError == nil && status.TotalBytesReclaimed > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, len(errCh), "the second failure is reported too")
+
+	status := bc.MergeStatus()
+	assert.Zero(t, status.Failures)
+	assert.False(t, status.LastRun.IsZero())
+	assert.Positive(t, status.LastDuration)
+
+	for i := 0; i < 30; i++ {
+		key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i)
+		if i == 0 {
+			val = "new0"
+		}
+		fetchedVal, err := bc.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.EqualValues(t, val, fetchedVal)
+	}
+}
+
+func TestMergeGarbageRatio(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	bc, err := New(
+		WithDirName(dirName),
+		WithSegmentSize(128), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval:     6 * time.Hour,
+			GarbageRatio: 0.5,
+		}),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+	defer bc.Close()
+
+	// fill a few segments, then overwrite the keys of the first ones
+	for i := 0; i < 30; i++ {
+		err = bc.Put([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("val%v", i)))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 6; i++ {
+		err = bc.Put([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("new%v", i)))
+		assert.Nil(t, err)
+	}
+	for i := 6; i < 9; i++ {
+		err = bc.Delete([]byte(fmt.Sprintf("key%v", i)))
+		assert.Nil(t, err)
+	}
+
+	err = bc.Put([]byte("filler"), make([]byte, 100))
+	assert.Nil(t, err)
+
+	bc.mu.Lock()
+	var garbageFiles, liveFiles []string
+	for _, fileName := range bc.manifest.DataFiles {
+		if extractID(fileName) == bc.manifest.ActiveID {
+			continue
+		}
+		if bc.fileStats(fileName).garbageRatio(time.Now()) >= 0.5 {
+			garbageFiles = append(garbageFiles, fileName)
+		} else {
+			liveFiles = append(liveFiles, fileName)
+		}
+	}
+	bc.mu.Unlock()
+	assert.NotEmpty(t, garbageFiles)
+	assert.NotEmpty(t, liveFiles)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = bc.Merge(ctx)
+	assert.Equal(t, context.Canceled, err)
+
+	err = bc.Merge(context.Background())
+	assert.Nil(t, err)
+
+	bc.mu.Lock()
+	for _, fileName := range garbageFiles {
+		assert.NotContains(t, bc.manifest.DataFiles, fileName)
+	}
+	for _, fileName := range liveFiles {
+		assert.Contains(t, bc.manifest.DataFiles, fileName)
+	}
+	// the only garbage of merge files is the tombstones of the keys the
+	// files that aren't merged still hold
+	for _, fileName := range bc.manifest.MergeFiles {
+		hint, err := OpenHint(dirName, getHintFilename(extractID(fileName)))
+		assert.Nil(t, err)
+
+		var tombstones int64
+		err = hint.forEach(func(key []byte, entry *Entry, tombstone bool) bool {
+			if tombstone {
+				assert.Contains(t, []string{"key6", "key7", "key8"}, string(key))
+				tombstones += bc.recordSize(key, entry)
+			}
+			return true
+		})
+		assert.Nil(t, err)
+		hint.Close()
+
+		stats := bc.fileStats(fileName)
+		assert.Equal(t, tombstones, stats.size-stats.live)
+	}
+	bc.mu.Unlock()
+	assert.Positive(t, bc.MergeStatus().BytesReclaimed)
+
+	for i := 0; i < 30; i++ {
+		key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i)
+		if i < 6 {
+			val = fmt.Sprintf("new%v", i)
+		}
+
+		fetchedVal, err := bc.Get([]byte(key))
+		if i >= 6 && i < 9 {
+			assert.Equal(t, ErrKeyNotFound, err)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.EqualValues(t, val, fetchedVal)
+	}
+}
+
+func TestMergeThrottle(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	const bytesPerSecond = 8 * 1024
+
+	bc, err := New(
+		WithDirName(dirName),
+		WithSegmentSize(128), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval:       6 * time.Hour,
+			BytesPerSecond: bytesPerSecond,
+			Concurrency:    4,
+		}),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+	defer bc.Close()
+
+	for i := 0; i < 100; i++ {
+		err = bc.Put([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("val%v", i)))
+		assert.Nil(t, err)
+	}
+
+	plan, err := bc.merger.planMerge(false)
+	assert.Nil(t, err)
+
+	// reading the merged files alone takes that long
+	minDuration := time.Duration(float64(plan.size) / bytesPerSecond * float64(time.Second))
+
+	start := time.Now()
+	err = bc.Merge(context.Background())
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), minDuration)
+
+	for i := 0; i < 100; i++ {
+		key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i)
+		fetchedVal, err := bc.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.EqualValues(t, val, fetchedVal)
+	}
+}
+
+func TestPauseMerge(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	bc, err := New(
+		WithDirName(dirName),
+		WithSegmentSize(128), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+	defer bc.Close()
+
+	for i := 0; i < 100; i++ {
+		err = bc.Put([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("val%v", i)))
+		assert.Nil(t, err)
+	}
+
+	bc.PauseMerge()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- bc.Merge(context.Background())
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("paused merge finished")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// the database keeps working while the merge is paused
+	err = bc.Put([]byte("key0"), []byte("new0"))
+	assert.Nil(t, err)
+	fetchedVal, err := bc.Get([]byte("key1"))
+	assert.Nil(t, err)
+	assert.EqualValues(t, "val1", fetchedVal)
+
+	bc.ResumeMerge()
+
+	select {
+	case err = <-done:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("resumed merge didn't finish")
+	}
+	assert.NotEmpty(t, bc.manifest.MergeFiles)
+
+	for i := 0; i < 100; i++ {
+		key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i)
+		if i == 0 {
+			val = "new0"
+		}
+
+		fetchedVal, err := bc.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.EqualValues(t, val, fetchedVal)
+	}
+}
+
+func TestMergeWindow(t *testing.T) {
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		name   string
+		window *MergeWindow
+		now    time.Duration
+		wait   time.Duration
+	}{
+		{"any time", nil, 13 * time.Hour, 0},
+		{"inside", &MergeWindow{Start: 2 * time.Hour, End: 4 * time.Hour}, 3 * time.Hour, 0},
+		{"before", &MergeWindow{Start: 2 * time.Hour, End: 4 * time.Hour}, time.Hour, time.Hour},
+		{"after", &MergeWindow{Start: 2 * time.Hour, End: 4 * time.Hour}, 5 * time.Hour, 21 * time.Hour},
+		{"across midnight, late", &MergeWindow{Start: 22 * time.Hour, End: 2 * time.Hour}, 23 * time.Hour, 0},
+		{"across midnight, early", &MergeWindow{Start: 22 * time.Hour, End: 2 * time.Hour}, time.Hour, 0},
+		{"across midnight, outside", &MergeWindow{Start: 22 * time.Hour, End: 2 * time.Hour}, 12 * time.Hour, 10 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.wait, tt.window.wait(day.Add(tt.now)))
+		})
+	}
+}
+
+func TestMergeSurvivesCrashAtEveryStep(t *testing.T) {
+	errCrash := errors.New("crash")
+
+	tests := []struct {
+		name  string
+		step  mergeStep
+		fault func(t *testing.T, dirName string, plan *mergePlan)
+	}{
+		{
+			name: "torn temporary files",
+			step: mergeStepWritten,
+			fault: func(t *testing.T, dirName string, plan *mergePlan) {
+				// groups without live records don't write any file
+				for _, id := range plan.ids {
+					hintPath := path.Join(dirName, getTmpFilename(getHintFilename(id)))
+					err := os.Truncate(hintPath, 3)
+					if !os.IsNotExist(err) {
+						assert.Nil(t, err)
+						return
+					}
+				}
+				t.Fatal("no temporary hint file")
+			},
+		},
+		{
+			name: "written",
+			step: mergeStepWritten,
+		},
+		{
+			name: "renamed",
+			step: mergeStepRenamed,
+		},
+		{
+			name: "published",
+			step: mergeStepPublished,
+			fault: func(t *testing.T, dirName string, plan *mergePlan) {
+				// killed while removing the merged files
+				err := os.Remove(path.Join(dirName, plan.files[0]))
+				assert.Nil(t, err)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dirName := "./test"
+			defer os.RemoveAll(dirName)
+
+			opts := []OptFn{
+				WithDirName(dirName),
+				WithSegmentSize(128), // bytes
+				WithSyncPolicy(SyncAlways),
+				WithMergeOpt(&MergeOption{
+					Interval: 6 * time.Hour,
+				}),
+			}
+
+			bc, err := New(opts...)
+			assert.Nil(t, err)
+			assert.NotNil(t, bc)
+
+			expected := make(map[string]string)
+			for round := 0; round < 2; round++ {
+				for i := 0; i < 30; i++ {
+					key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v-%v", i, round)
+					err = bc.Put([]byte(key), []byte(val))
+					assert.Nil(t, err)
+					expected[key] = val
+				}
+			}
+
+			// rotate, so that every key under test gets merged
+			err = bc.Put([]byte("filler"), make([]byte, 100))
+			assert.Nil(t, err)
+
+			plan, err := bc.merger.planMerge(false)
+			assert.Nil(t, err)
+
+			bc.merger.faultHook = func(step mergeStep) error {
+				if step != tt.step {
+					return nil
+				}
+				if tt.fault != nil {
+					tt.fault(t, dirName, plan)
+				}
+				return errCrash
+			}
+			err = bc.Merge(context.Background())
+			assert.Equal(t, errCrash, err)
+
+			// every write is synced
+			synced, err := bc.activeSegment.GetOffset()
+			assert.Nil(t, err)
+			crash(t, bc, synced)
+
+			bc, err = New(opts...)
+			assert.Nil(t, err)
+			assert.NotNil(t, bc)
+			defer bc.Close()
+
+			check := func() {
+				for key, val := range expected {
+					fetchedVal, err := bc.Get([]byte(key))
+					assert.Nil(t, err)
+					assert.EqualValues(t, val, fetchedVal)
+				}
+
+				// nothing but the files of the manifest is left
+				dirEntries, err := os.ReadDir(dirName)
+				assert.Nil(t, err)
+				filesName := bc.manifest.files()
+				for _, dirEntry := range dirEntries {
+					fileName := dirEntry.Name()
+					if fileName == manifestFilename {
+						continue
+					}
+					assert.Contains(t, filesName, fileName)
+				}
+			}
+			check()
+
+			// merging again works
+			err = bc.Merge(context.Background())
+			assert.Nil(t, err)
+			check()
+		})
+	}
+}
+
+func TestMergeKeepsTombstones(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	opts := []OptFn{
+		WithDirName(dirName),
+		WithSegmentSize(256), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval:     6 * time.Hour,
+			GarbageRatio: 0.5,
+		}),
+	}
+
+	bc, err := New(opts...)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+
+	// the older values of deleted and expired keys stay in files that
+	// aren't merged
+	err = bc.Put([]byte("deleted"), []byte("val"))
+	assert.Nil(t, err)
+	err = bc.Put([]byte("expired"), []byte("val"))
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		err = bc.Put([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("val%v", i)))
+		assert.Nil(t, err)
+	}
+	entry, _ := bc.keyDir.Get([]byte("deleted"))
+	oldFilename := entry.FileID
+
+	err = bc.Delete([]byte("deleted"))
+	assert.Nil(t, err)
+	err = bc.PutWithTTL([]byte("expired"), []byte("val"), 50*time.Millisecond)
+	assert.Nil(t, err)
+	for i := 0; i < 20; i++ {
+		err = bc.Put([]byte("churn"), []byte(fmt.Sprintf("val%v", i)))
+		assert.Nil(t, err)
+	}
+
+	<-time.After(100 * time.Millisecond)
+
+	err = bc.Merge(context.Background())
+	assert.Nil(t, err)
+	assert.Contains(t, bc.manifest.DataFiles, oldFilename)
+	assert.NotEmpty(t, bc.manifest.MergeFiles)
+
+	tombstones := func() map[string]bool {
+		keys := make(map[string]bool)
+		for _, hintFilename := range bc.manifest.HintFiles {
+			hint, err := OpenHint(dirName, hintFilename)
+			assert.Nil(t, err)
+
+			err = hint.forEach(func(key []byte, entry *Entry, tombstone bool) bool {
+				if tombstone {
+					keys[string(key)] = true
+				}
+				return true
+			})
+			assert.Nil(t, err)
+			hint.Close()
+		}
+		return keys
+	}
+	assert.Equal(t, map[string]bool{"deleted": true, "expired": true}, tombstones())
+
+	check := func() {
+		for _, key := range []string{"deleted", "expired"} {
+			_, err := bc.Get([]byte(key))
+			assert.Equal(t, ErrKeyNotFound, err, key)
+		}
+
+		fetchedVal, err := bc.Get([]byte("churn"))
+		assert.Nil(t, err)
+		assert.EqualValues(t, "val19", fetchedVal)
+	}
+	check()
+
+	err = bc.Close()
+	assert.Nil(t, err)
+
+	bc, err = New(opts...)
+	assert.Nil(t, err)
+	check()
+
+	// once the older values are merged, the tombstones aren't needed anymore
+	err = bc.Put([]byte("churn"), []byte("val20"))
+	assert.Nil(t, err)
+	err = bc.Put([]byte("filler"), make([]byte, 200))
+	assert.Nil(t, err)
+	err = bc.Close()
+	assert.Nil(t, err)
+
+	bc, err = New(append(opts, WithMergeOpt(&MergeOption{
+		Interval: 6 * time.Hour,
+	}))...)
+	assert.Nil(t, err)
+	defer bc.Close()
+
+	err = bc.Merge(context.Background())
+	assert.Nil(t, err)
+	assert.NotContains(t, bc.manifest.DataFiles, oldFilename)
+	assert.Empty(t, tombstones())
+
+	for _, key := range []string{"deleted", "expired"} {
+		_, err := bc.Get([]byte(key))
+		assert.Equal(t, ErrKeyNotFound, err, key)
+	}
+}
@@ -1,18 +1,197 @@
 package gobitcask
 
-import "time"
+import (
+	"fmt"
+	"log"
+	"time"
+)
 
 type OptFn func(*Option)
 
+// SyncPolicy controls when writes are flushed to stable storage.
+type SyncPolicy int
+
+const (
+	// SyncNever leaves flushing to the operating system. Data is synced
+	// only on segment rotation, Close or an explicit call to Sync.
+	SyncNever SyncPolicy = iota
+	// SyncAlways syncs the active segment after every write.
+	SyncAlways
+	// SyncInterval syncs the active segment in the background every
+	// Option.SyncInterval, which must be positive.
+	SyncInterval
+)
+
+// RecoveryMode controls how corrupted records are handled when the database
+// is opened.
+type RecoveryMode int
+
+const (
+	// RecoveryTruncateTail cuts off an incomplete or corrupted tail of the
+	// newest data file, which is what a crash in the middle of a write
+	// leaves behind: a corrupted record that no valid record follows.
+	// Corruption anywhere else fails the open.
+	RecoveryTruncateTail RecoveryMode = iota
+	// RecoveryStrict fails the open on any corrupted record.
+	RecoveryStrict
+	// RecoverySkipCorrupt truncates a torn tail like RecoveryTruncateTail
+	// and skips corrupted records everywhere else.
+	RecoverySkipCorrupt
+)
+
+// IndexType selects the in-memory index used for the key dir.
+type IndexType int
+
+const (
+	// HashIndex keeps the key dir in a hash map. Keys are unordered.
+	HashIndex IndexType = iota
+	// BTreeIndex keeps the key dir in a B-tree, which enables Scan,
+	// ReverseScan and PrefixScan and makes ListKeys and Fold return keys in
+	// ascending order.
+	BTreeIndex
+)
+
 type Option struct {
-	DirName     string
-	SegmentSize int
-	MergeOpt    *MergeOption
+	DirName      string
+	SegmentSize  int
+	MergeOpt     *MergeOption
+	ReadOnly     bool
+	SyncPolicy   SyncPolicy
+	SyncInterval time.Duration
+	RecoveryMode RecoveryMode
+	Logger       *log.Logger
+	Index        IndexType
+	Repair       bool
+	Compressor   Compressor
+	KeyProvider  KeyProvider
+
+	keys *keyRing
+}
+
+// validate checks the options New is given.
+func (o *Option) validate() error {
+	if o.SyncPolicy == SyncInterval && o.SyncInterval <= 0 {
+		return fmt.Errorf("%w: sync interval %v isn't positive", ErrInvalidOption, o.SyncInterval)
+	}
+
+	// a read-only database never merges
+	if !o.ReadOnly {
+		if o.MergeOpt == nil {
+			return fmt.Errorf("%w: no merge option", ErrInvalidOption)
+		}
+		if o.MergeOpt.Interval <= 0 {
+			return fmt.Errorf("%w: merge interval %v isn't positive", ErrInvalidOption, o.MergeOpt.Interval)
+		}
+	}
+
+	if o.Compressor != nil {
+		id := o.Compressor.ID()
+		if id == 0 || id > flagCompressorMask {
+			return fmt.Errorf("%w: compressor ID %v isn't between 1 and %v", ErrInvalidOption, id, flagCompressorMask)
+		}
+	}
+
+	return nil
 }
 
 type MergeOption struct {
+	// Interval is the time between background merges. It must be positive.
 	Interval time.Duration
 	MinFiles int
+	// BufferSize is the size of the buffers records are read and written
+	// through while merging, 1 MB if 0. Together with the largest record it
+	// bounds the memory a merge needs.
+	BufferSize int
+	// OnError is called from the background merger with the error of every
+	// merge that fails. The merge is retried after RetryBackoff, which
+	// doubles with each failure in a row up to Interval; 1 second if 0.
+	OnError      func(err error)
+	RetryBackoff time.Duration
+	// GarbageRatio is the share of a file that must be garbage, i.e.
+	// overwritten, deleted or expired, for it to be merged: 0.5 merges the
+	// files that are at least half garbage. With 0, every data file but the
+	// active segment is merged, and merge files once they hold garbage.
+	GarbageRatio float64
+	// Window restricts background merges to a time of day, any time if nil.
+	// Merges started with Bitcask.Merge ignore it.
+	Window *MergeWindow
+	// BytesPerSecond limits the I/O of merges: the bytes read and written
+	// together, unlimited if 0.
+	BytesPerSecond int64
+	// Concurrency is the number of merge files written at once, 1 if 0,
+	// which is also the number of CPUs a merge keeps busy at most.
+	Concurrency int
+}
+
+// MergeWindow is a daily time window, given as offsets from midnight in local
+// time. A window whose End is before its Start spans midnight.
+type MergeWindow struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// wait returns how long it takes from now until the window opens, 0 if it's
+// open or if w is nil.
+func (w *MergeWindow) wait(now time.Time) time.Duration {
+	if w == nil {
+		return 0
+	}
+
+	year, month, day := now.Date()
+	offset := now.Sub(time.Date(year, month, day, 0, 0, 0, 0, now.Location()))
+
+	var open bool
+	if w.Start <= w.End {
+		open = offset >= w.Start && offset < w.End
+	} else {
+		open = offset >= w.Start || offset < w.End
+	}
+	if open {
+		return 0
+	}
+
+	wait := w.Start - offset
+	if wait < 0 {
+		wait += 24 * time.Hour
+	}
+
+	return wait
+}
+
+const (
+	defaultMergeBufferSize   = 1 << 20 // 1 MB
+	defaultMergeRetryBackoff = time.Second
+)
+
+func (o *MergeOption) bufferSize() int {
+	if o.BufferSize <= 0 {
+		return defaultMergeBufferSize
+	}
+
+	return o.BufferSize
+}
+
+func (o *MergeOption) concurrency() int {
+	if o.Concurrency <= 0 {
+		return 1
+	}
+
+	return o.Concurrency
+}
+
+// retryDelay returns how long to wait before retrying after the given
+// number of failed merges in a row.
+func (o *MergeOption) retryDelay(failures int) time.Duration {
+	delay := o.RetryBackoff
+	if delay <= 0 {
+		delay = defaultMergeRetryBackoff
+	}
+
+	for i := 1; i < failures && delay < o.Interval; i++ {
+		delay *= 2
+	}
+
+	return min(delay, o.Interval)
 }
 
 func WithDirName(dirName string) OptFn {
@@ -32,3 +211,116 @@ func WithMergeOpt(mergeOpt *MergeOption) OptFn {
 		o.MergeOpt = mergeOpt
 	}
 }
+
+// WithReadOnly opens the database for reading only. No file is created or
+// modified, merging is disabled and Put/Delete return ErrReadOnly. Several
+// read-only instances may share a directory, but not with a writer.
+func WithReadOnly() OptFn {
+	return func(o *Option) {
+		o.ReadOnly = true
+	}
+}
+
+func WithSyncPolicy(policy SyncPolicy) OptFn {
+	return func(o *Option) {
+		o.SyncPolicy = policy
+	}
+}
+
+// WithSyncInterval syncs the active segment in the background every interval.
+func WithSyncInterval(interval time.Duration) OptFn {
+	return func(o *Option) {
+		o.SyncPolicy = SyncInterval
+		o.SyncInterval = interval
+	}
+}
+
+func WithRecoveryMode(mode RecoveryMode) OptFn {
+	return func(o *Option) {
+		o.RecoveryMode = mode
+	}
+}
+
+func WithLogger(logger *log.Logger) OptFn {
+	return func(o *Option) {
+		o.Logger = logger
+	}
+}
+
+func WithIndex(index IndexType) OptFn {
+	return func(o *Option) {
+		o.Index = index
+	}
+}
+
+// WithRepair rebuilds the MANIFEST from the files in the directory if it's
+// damaged or lists files that are missing, instead of failing to open.
+func WithRepair() OptFn {
+	return func(o *Option) {
+		o.Repair = true
+	}
+}
+
+// WithCompressor compresses the values written from now on with c. Values
+// written before are compressed when they're merged.
+func WithCompressor(c Compressor) OptFn {
+	return func(o *Option) {
+		o.Compressor = c
+	}
+}
+
+// WithKeyProvider encrypts the keys and values written from now on with
+// AES-GCM, using the keys of p. Records written before are encrypted when
+// they're merged.
+func WithKeyProvider(p KeyProvider) OptFn {
+	return func(o *Option) {
+		o.KeyProvider = p
+	}
+}
+
+type IterOptFn func(o *IterOption)
+
+type IterOption struct {
+	Prefix     []byte
+	KeysOnly   bool
+	LazyValues bool
+	Reverse    bool
+}
+
+// bounds returns the key range selected by the options.
+func (o *IterOption) bounds() ([]byte, []byte) {
+	if o.Prefix == nil {
+		return nil, nil
+	}
+
+	return o.Prefix, prefixEnd(o.Prefix)
+}
+
+// WithPrefix only iterates over the keys starting with prefix.
+func WithPrefix(prefix []byte) IterOptFn {
+	return func(o *IterOption) {
+		o.Prefix = prefix
+	}
+}
+
+// WithKeysOnly doesn't read any value, Iterator.Value returns nil.
+func WithKeysOnly() IterOptFn {
+	return func(o *IterOption) {
+		o.KeysOnly = true
+	}
+}
+
+// WithLazyValues reads a value only when Iterator.Value is called instead of
+// in Iterator.Next.
+func WithLazyValues() IterOptFn {
+	return func(o *IterOption) {
+		o.LazyValues = true
+	}
+}
+
+// WithReverse iterates in descending key order. It requires the BTreeIndex.
+func WithReverse() IterOptFn {
+	return func(o *IterOption) {
+		o.Reverse = true
+	}
+}
@@ -10,6 +10,7 @@ type Segment struct {
 	f        *os.File
 	id       string
 	readOnly bool
+	format   fileFormat
 }
 
 func OpenSegment(dir, id string) (*Segment, error) {
@@ -19,26 +20,65 @@ func OpenSegment(dir, id string) (*Segment, error) {
 		return nil, err
 	}
 
+	format, err := readFormat(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
 	return &Segment{
 		f:        f,
 		id:       id,
 		readOnly: true,
+		format:   format,
 	}, nil
 }
 
+// NewSegment opens the segment id for appending, creating it with a header
+// if it doesn't exist. The segment must be of the current format.
 func NewSegment(dir, id string) (*Segment, error) {
 	filePath := path.Join(dir, id)
-	f, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY, 0755)
+	f, err := os.OpenFile(filePath, os.O_CREATE|os.O_RDWR, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	format, err := readFormat(f)
 	if err != nil {
+		f.Close()
 		return nil, err
 	}
 
+	// a header cut off by a crash is written again
+	if info.Size() < int64(format.offset) {
+		err = f.Truncate(0)
+		if err == nil {
+			_, err = f.WriteAt(fileHeader(), 0)
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
 	return &Segment{
-		f:  f,
-		id: id,
+		f:      f,
+		id:     id,
+		format: format,
 	}, nil
 }
 
+// DataOffset returns the offset of the first record of the segment.
+func (s *Segment) DataOffset() int {
+	return s.format.offset
+}
+
 func (s *Segment) Read(offset, n int) ([]byte, error) {
 	b := make([]byte, n)
 
@@ -76,6 +116,10 @@ func (s *Segment) GetID() string {
 	return s.id
 }
 
+func (s *Segment) Sync() error {
+	return s.f.Sync()
+}
+
 func (s *Segment) Close() error {
 	err := s.f.Sync()
 	if err != nil {
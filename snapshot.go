@@ -0,0 +1,100 @@
+package gobitcask
+
+import "sync"
+
+// Snapshot is a read-only, point-in-time view of the database. Writes and
+// merges that happen after it was taken aren't visible to it, and the files
+// it reads from are kept until it's released. A Snapshot is safe for
+// concurrent use.
+type Snapshot struct {
+	db       *Bitcask
+	snapshot KeyDirSnapshot
+	pin      uint64
+
+	mu sync.Mutex
+	// refs counts the snapshot itself and its open iterators, the key dir
+	// snapshot and the pinned files are released once it drops to zero.
+	refs     int
+	released bool
+}
+
+// Snapshot returns a view of the database as it is now. It must be released
+// once it's no longer used.
+func (b *Bitcask) Snapshot() *Snapshot {
+	pin := b.pinFiles()
+
+	return &Snapshot{
+		db:       b,
+		snapshot: b.keyDir.Snapshot(),
+		pin:      pin,
+		refs:     1,
+	}
+}
+
+func (s *Snapshot) Get(key []byte) ([]byte, error) {
+	if !s.ref() {
+		return nil, ErrSnapshotReleased
+	}
+	defer s.unref()
+
+	entry, exist := s.snapshot.Get(key)
+	if !exist {
+		return nil, ErrKeyNotFound
+	}
+
+	return s.db.read(key, entry)
+}
+
+// Iterator returns an iterator over the keys of the snapshot, see
+// Bitcask.Iterator. The iterator keeps working after Release until it's
+// closed.
+func (s *Snapshot) Iterator(optsFn ...IterOptFn) *Iterator {
+	opts := &IterOption{}
+	for _, optFn := range optsFn {
+		optFn(opts)
+	}
+
+	if !s.ref() {
+		return &Iterator{opts: opts, err: ErrSnapshotReleased, release: func() {}}
+	}
+
+	start, end := opts.bounds()
+	return newIterator(s.db, s.snapshot, start, end, opts, s.unref)
+}
+
+// Release releases the snapshot. It's safe to call Release more than once.
+func (s *Snapshot) Release() {
+	s.mu.Lock()
+	if s.released {
+		s.mu.Unlock()
+		return
+	}
+	s.released = true
+	s.mu.Unlock()
+
+	s.unref()
+}
+
+func (s *Snapshot) ref() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.released {
+		return false
+	}
+
+	s.refs++
+	return true
+}
+
+func (s *Snapshot) unref() {
+	s.mu.Lock()
+	s.refs--
+	refs := s.refs
+	s.mu.Unlock()
+
+	if refs == 0 {
+		s.snapshot.Release()
+		s.db.unpinFiles(s.pin)
+	}
+}
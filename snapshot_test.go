@@ -0,0 +1,105 @@
+package gobitcask
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshot(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	bc, err := New(
+		WithDirName(dirName),
+		WithSegmentSize(128), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 10 * time.Millisecond,
+		}),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+	defer bc.Close()
+
+	for i := 0; i < 50; i++ {
+		key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i)
+		err = bc.Put([]byte(key), []byte(val))
+		assert.Nil(t, err)
+	}
+
+	snapshot := bc.Snapshot()
+	it := snapshot.Iterator(WithKeysOnly())
+
+	pinnedFiles := make([]string, 0)
+	dirEntries, err := os.ReadDir(dirName)
+	assert.Nil(t, err)
+	for _, dirEntry := range dirEntries {
+		if path.Ext(dirEntry.Name()) == ".data" {
+			pinnedFiles = append(pinnedFiles, path.Join(dirName, dirEntry.Name()))
+		}
+	}
+
+	filesExist := func() int {
+		count := 0
+		for _, filePath := range pinnedFiles {
+			if _, err := os.Stat(filePath); err == nil {
+				count++
+			}
+		}
+		return count
+	}
+
+	for i := 0; i < 50; i++ {
+		key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("new%v", i)
+		if i%2 == 0 {
+			err = bc.Delete([]byte(key))
+		} else {
+			err = bc.Put([]byte(key), []byte(val))
+		}
+		assert.Nil(t, err)
+	}
+	err = bc.Put([]byte("key50"), []byte("new50"))
+	assert.Nil(t, err)
+
+	// let the merger compact the segments the snapshot reads from
+	<-time.After(200 * time.Millisecond)
+	assert.Equal(t, len(pinnedFiles), filesExist())
+
+	for i := 0; i < 50; i++ {
+		key, val := fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i)
+		fetchedVal, err := snapshot.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.EqualValues(t, val, fetchedVal)
+	}
+	_, err = snapshot.Get([]byte("key50"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// the iterator keeps the snapshot alive after it's released
+	snapshot.Release()
+	snapshot.Release()
+
+	_, err = snapshot.Get([]byte("key1"))
+	assert.Equal(t, ErrSnapshotReleased, err)
+
+	it2 := snapshot.Iterator()
+	assert.False(t, it2.Next())
+	assert.Equal(t, ErrSnapshotReleased, it2.Err())
+	assert.Nil(t, it2.Close())
+
+	count := 0
+	for it.Next() {
+		count++
+	}
+	assert.Nil(t, it.Err())
+	assert.Equal(t, 50, count)
+
+	assert.Equal(t, len(pinnedFiles), filesExist())
+
+	// closing the last iterator lets the merged segments go
+	assert.Nil(t, it.Close())
+	assert.Less(t, filesExist(), len(pinnedFiles))
+}
@@ -0,0 +1,156 @@
+package gobitcask
+
+import (
+	"os"
+	"path"
+	"time"
+)
+
+// fileStats counts the bytes of a data or merge file, and how many of them
+// belong to records the key dir refers to. The rest is garbage that merging
+// the file reclaims: overwritten and deleted values, tombstones, commit
+// records. Tombstones that merge keeps count as garbage too, so that the
+// merge files holding them are merged again and the tombstones dropped once
+// no older file needs them. Values of expired keys are garbage as well, but
+// the key dir refers to them until the file is merged, so they're counted
+// in live and told apart by when they expire.
+type fileStats struct {
+	size int64
+	live int64
+	// expiring sums the live bytes of the values with a TTL by the second
+	// they expire at, rounded up.
+	expiring map[int64]int64
+	format   fileFormat
+}
+
+// liveSize returns the live bytes of the file whose values aren't expired
+// at now.
+func (s *fileStats) liveSize(now time.Time) int64 {
+	live := s.live
+	for second, size := range s.expiring {
+		if second <= now.Unix() {
+			live -= size
+		}
+	}
+
+	return live
+}
+
+// garbageRatio returns the share of the file that is garbage at now.
+func (s *fileStats) garbageRatio(now time.Time) float64 {
+	if s.size == 0 {
+		return 0
+	}
+
+	return float64(s.size-s.liveSize(now)) / float64(s.size)
+}
+
+// recordSize returns the size of the record entry refers to. The caller
+// must hold b.mu.
+func (b *Bitcask) recordSize(key []byte, entry *Entry) int64 {
+	headerLen := b.fileStats(entry.FileID).format.headerLen()
+	return int64(headerLen + len(key) + entry.ValueSize)
+}
+
+// countEntry counts the record entry refers to as live, or no longer if
+// sign is -1. The caller must hold b.mu.
+func (b *Bitcask) countEntry(key []byte, entry *Entry, sign int64) {
+	stats := b.fileStats(entry.FileID)
+	size := sign * b.recordSize(key, entry)
+	stats.live += size
+
+	if entry.Expiry == 0 {
+		return
+	}
+	if stats.expiring == nil {
+		stats.expiring = make(map[int64]int64)
+	}
+	second := (entry.Expiry + int64(time.Second) - 1) / int64(time.Second)
+	stats.expiring[second] += size
+	if stats.expiring[second] == 0 {
+		delete(stats.expiring, second)
+	}
+}
+
+// fileStats returns the stats of fileName. The caller must hold b.mu.
+func (b *Bitcask) fileStats(fileName string) *fileStats {
+	stats, ok := b.stats[fileName]
+	if !ok {
+		stats = &fileStats{format: currentFileFormat}
+		b.stats[fileName] = stats
+	}
+
+	return stats
+}
+
+// loadFileStats computes the stats of the files of the manifest from the key
+// dir once it's warmed up. File headers count as live.
+func (b *Bitcask) loadFileStats() error {
+	for _, filesName := range [][]string{b.manifest.DataFiles, b.manifest.MergeFiles} {
+		for _, fileName := range filesName {
+			filePath := path.Join(b.option.DirName, fileName)
+			info, err := os.Stat(filePath)
+			if err != nil {
+				return err
+			}
+
+			format, err := readFileFormat(filePath)
+			if err != nil {
+				return err
+			}
+
+			stats := b.fileStats(fileName)
+			stats.size = info.Size()
+			stats.format = format
+			stats.live = int64(min(format.offset, int(info.Size())))
+		}
+	}
+
+	b.keyDir.Scan(func(key []byte, entry *Entry) bool {
+		b.countEntry(key, entry, 1)
+		return true
+	})
+
+	return nil
+}
+
+// setEntry points key at entry, or deletes the key if entry is nil, and
+// accounts for the value it replaces. The caller must hold b.mu.
+func (b *Bitcask) setEntry(key []byte, entry *Entry) {
+	old, ok := b.keyDir.Lookup(key)
+	if ok {
+		b.countEntry(key, old, -1)
+	}
+
+	if entry == nil {
+		b.keyDir.Delete(key)
+		return
+	}
+
+	b.countEntry(key, entry, 1)
+	b.keyDir.Set(key, entry)
+}
+
+// setEntries is like setEntry for all the given keys at once, see
+// KeyDir.Apply. The caller must hold b.mu.
+func (b *Bitcask) setEntries(keys [][]byte, entries []*Entry) {
+	// a key may be written several times by a batch
+	written := make(map[string]*Entry, len(keys))
+	for idx, key := range keys {
+		old, ok := written[string(key)]
+		if !ok {
+			old, _ = b.keyDir.Lookup(key)
+		}
+		if old != nil {
+			b.countEntry(key, old, -1)
+		}
+
+		entry := entries[idx]
+		if entry != nil {
+			b.countEntry(key, entry, 1)
+		}
+		written[string(key)] = entry
+	}
+
+	b.keyDir.Apply(keys, entries)
+}
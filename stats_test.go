@@ -0,0 +1,172 @@
+package gobitcask
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileStats(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	opts := []OptFn{
+		WithDirName(dirName),
+		WithSegmentSize(128), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	}
+
+	bc, err := New(opts...)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+
+	for i := 0; i < 20; i++ {
+		err = bc.Put([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("val%v", i)))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 20; i += 2 {
+		err = bc.Put([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("new%v", i)))
+		assert.Nil(t, err)
+	}
+	for i := 1; i < 20; i += 4 {
+		err = bc.Delete([]byte(fmt.Sprintf("key%v", i)))
+		assert.Nil(t, err)
+	}
+
+	batch := bc.NewBatch()
+	batch.Put([]byte("key2"), []byte("batch2"))
+	batch.Put([]byte("key2"), []byte("batch2-again"))
+	batch.Delete([]byte("key3"))
+	err = batch.Commit()
+	assert.Nil(t, err)
+
+	// every file is as large as its stats say and only its header and the
+	// records the key dir refers to are live
+	check := func() {
+		bc.mu.Lock()
+		defer bc.mu.Unlock()
+
+		live := make(map[string]int64)
+		for _, fileName := range append(bc.manifest.DataFiles, bc.manifest.MergeFiles...) {
+			live[fileName] = int64(fileHeaderLen)
+		}
+		bc.keyDir.ForEach(func(key []byte, entry *Entry) bool {
+			live[entry.FileID] += bc.recordSize(key, entry)
+			return true
+		})
+
+		for _, fileName := range append(bc.manifest.DataFiles, bc.manifest.MergeFiles...) {
+			info, err := os.Stat(path.Join(dirName, fileName))
+			assert.Nil(t, err)
+
+			stats := bc.fileStats(fileName)
+			assert.Equal(t, info.Size(), stats.size, fileName)
+			assert.Equal(t, live[fileName], stats.live, fileName)
+		}
+	}
+	check()
+
+	err = bc.Merge(context.Background())
+	assert.Nil(t, err)
+	check()
+
+	// the merge files get garbage too, and are merged again
+	bc.mu.Lock()
+	mergeFiles := append([]string(nil), bc.manifest.MergeFiles...)
+	bc.mu.Unlock()
+	assert.NotEmpty(t, mergeFiles)
+
+	for i := 0; i < 20; i++ {
+		err = bc.Put([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("last%v", i)))
+		assert.Nil(t, err)
+	}
+	err = bc.Put([]byte("filler"), make([]byte, 100))
+	assert.Nil(t, err)
+	check()
+
+	err = bc.Merge(context.Background())
+	assert.Nil(t, err)
+	check()
+
+	bc.mu.Lock()
+	for _, fileName := range mergeFiles {
+		assert.NotContains(t, bc.manifest.MergeFiles, fileName)
+	}
+	bc.mu.Unlock()
+
+	err = bc.Close()
+	assert.Nil(t, err)
+
+	bc, err = New(opts...)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+	defer bc.Close()
+
+	check()
+	for i := 0; i < 20; i++ {
+		fetchedVal, err := bc.Get([]byte(fmt.Sprintf("key%v", i)))
+		assert.Nil(t, err)
+		assert.EqualValues(t, fmt.Sprintf("last%v", i), fetchedVal)
+	}
+}
+
+func TestExpiredValuesAreGarbage(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	bc, err := New(
+		WithDirName(dirName),
+		WithSegmentSize(128), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval:     6 * time.Hour,
+			GarbageRatio: 0.5,
+		}),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+	defer bc.Close()
+
+	for i := 0; i < 20; i++ {
+		err = bc.PutWithTTL([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("val%v", i)), time.Second)
+		assert.Nil(t, err)
+	}
+	err = bc.Put([]byte("filler"), make([]byte, 100))
+	assert.Nil(t, err)
+
+	bc.mu.Lock()
+	expiredFiles := append([]string(nil), bc.manifest.DataFiles[:len(bc.manifest.DataFiles)-1]...)
+	bc.mu.Unlock()
+	assert.NotEmpty(t, expiredFiles)
+
+	// nothing expired yet
+	err = bc.Merge(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, MergeStatus{}, bc.MergeStatus())
+
+	// expiry is tracked by the second
+	<-time.After(2100 * time.Millisecond)
+
+	bc.mu.Lock()
+	for _, fileName := range expiredFiles {
+		assert.Greater(t, bc.fileStats(fileName).garbageRatio(time.Now()), 0.5, fileName)
+	}
+	bc.mu.Unlock()
+
+	err = bc.Merge(context.Background())
+	assert.Nil(t, err)
+
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	for _, fileName := range expiredFiles {
+		assert.NotContains(t, bc.manifest.DataFiles, fileName)
+	}
+	assert.Empty(t, bc.manifest.MergeFiles)
+	assert.Len(t, bc.keyDir.GetKeys(), 1)
+}
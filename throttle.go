@@ -0,0 +1,104 @@
+package gobitcask
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimiter spreads the bytes it's told about over time so that no more
+// than rate bytes per second go through on average. Time spent idle isn't
+// saved up for later.
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate float64   // bytes per second
+	next time.Time // when the bytes so far are paid off
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+
+	return &rateLimiter{rate: float64(bytesPerSecond)}
+}
+
+// wait accounts for n bytes and waits until they are paid off. A nil limiter
+// doesn't limit anything.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+	delay := l.next.Sub(now)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttle holds back the I/O of a merge: it's slowed down to
+// MergeOption.BytesPerSecond and stopped while the merger is paused.
+type throttle struct {
+	ctx context.Context
+	m   *Merger
+}
+
+func (t *throttle) wait(n int) error {
+	err := t.m.waitResumed(t.ctx)
+	if err != nil {
+		return err
+	}
+
+	return t.m.limiter.wait(t.ctx, n)
+}
+
+type throttledReader struct {
+	r io.Reader
+	t *throttle
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	err := r.t.wait(0)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := r.r.Read(p)
+	if n > 0 {
+		waitErr := r.t.wait(n)
+		if waitErr != nil {
+			return n, waitErr
+		}
+	}
+
+	return n, err
+}
+
+type throttledWriter struct {
+	w io.Writer
+	t *throttle
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	err := w.t.wait(len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	return w.w.Write(p)
+}
@@ -0,0 +1,110 @@
+package gobitcask
+
+// Tx is an optimistic read-modify-write transaction. Every entry read through
+// the transaction is remembered, and the transaction only commits if none of
+// those keys were rewritten in the meantime. Writes are buffered and committed
+// atomically like a Batch.
+type Tx struct {
+	db     *Bitcask
+	reads  map[string]*Entry // nil if the key didn't exist when read
+	writes map[string]*batchOp
+	ops    []*batchOp
+}
+
+// Update runs fn in a transaction and commits it if fn returns no error.
+// ErrConflict is returned if a key read by fn was changed by someone else
+// before the commit; the caller may retry in that case.
+func (b *Bitcask) Update(fn func(tx *Tx) error) error {
+	tx := &Tx{
+		db:     b,
+		reads:  make(map[string]*Entry),
+		writes: make(map[string]*batchOp),
+	}
+
+	err := fn(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.commit()
+}
+
+func (tx *Tx) Get(key []byte) ([]byte, error) {
+	if op, ok := tx.writes[string(key)]; ok {
+		if op.delete {
+			return nil, ErrKeyNotFound
+		}
+		return append([]byte(nil), op.val...), nil
+	}
+
+	entry, exist := tx.db.keyDir.Get(key)
+	if _, ok := tx.reads[string(key)]; !ok {
+		tx.reads[string(key)] = entry
+	}
+
+	if !exist {
+		return nil, ErrKeyNotFound
+	}
+
+	return tx.db.get(key, entry)
+}
+
+func (tx *Tx) Put(key, val []byte) {
+	op := &batchOp{
+		key: append([]byte(nil), key...),
+		val: append([]byte(nil), val...),
+	}
+
+	tx.ops = append(tx.ops, op)
+	tx.writes[string(key)] = op
+}
+
+func (tx *Tx) Delete(key []byte) {
+	op := &batchOp{
+		key:    append([]byte(nil), key...),
+		delete: true,
+	}
+
+	tx.ops = append(tx.ops, op)
+	tx.writes[string(key)] = op
+}
+
+func (tx *Tx) commit() error {
+	if len(tx.ops) > 0 && tx.db.option.ReadOnly {
+		return ErrReadOnly
+	}
+
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+
+	for key, readEntry := range tx.reads {
+		entry, _ := tx.db.keyDir.Get([]byte(key))
+		if !sameEntry(entry, readEntry) {
+			return ErrConflict
+		}
+	}
+
+	if len(tx.ops) == 0 {
+		return nil
+	}
+
+	keys, entries, err := tx.db.writeBatch(tx.ops)
+	if err != nil {
+		return err
+	}
+
+	tx.db.setEntries(keys, entries)
+
+	return nil
+}
+
+// sameEntry reports whether both entries stand for the same write, i.e. the
+// key wasn't rewritten in between, even if a merge moved its record. Nil
+// stands for a missing key.
+func sameEntry(a, b *Entry) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return a.seq == b.seq
+}
@@ -0,0 +1,201 @@
+package gobitcask
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTxReadYourWrites(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	bc, err := New(
+		WithDirName(dirName),
+		WithSegmentSize(1024), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+	defer bc.Close()
+
+	err = bc.Put([]byte("key1"), []byte("val1"))
+	assert.Nil(t, err)
+
+	err = bc.Update(func(tx *Tx) error {
+		val, err := tx.Get([]byte("key1"))
+		assert.Nil(t, err)
+		assert.EqualValues(t, "val1", val)
+
+		tx.Put([]byte("key2"), val)
+		tx.Delete([]byte("key1"))
+
+		val, err = tx.Get([]byte("key2"))
+		assert.Nil(t, err)
+		assert.EqualValues(t, "val1", val)
+
+		_, err = tx.Get([]byte("key1"))
+		assert.Equal(t, ErrKeyNotFound, err)
+
+		return nil
+	})
+	assert.Nil(t, err)
+
+	_, err = bc.Get([]byte("key1"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	val, err := bc.Get([]byte("key2"))
+	assert.Nil(t, err)
+	assert.EqualValues(t, "val1", val)
+}
+
+func TestTxConflict(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	bc, err := New(
+		WithDirName(dirName),
+		WithSegmentSize(1024), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+	defer bc.Close()
+
+	err = bc.Put([]byte("key1"), []byte("val1"))
+	assert.Nil(t, err)
+
+	// the key read by the transaction is rewritten before the commit
+	err = bc.Update(func(tx *Tx) error {
+		_, err := tx.Get([]byte("key1"))
+		assert.Nil(t, err)
+
+		err = bc.Put([]byte("key1"), []byte("val2"))
+		assert.Nil(t, err)
+
+		tx.Put([]byte("key2"), []byte("val1"))
+		return nil
+	})
+	assert.Equal(t, ErrConflict, err)
+
+	_, err = bc.Get([]byte("key2"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// the key missing when read by the transaction is created before the commit
+	err = bc.Update(func(tx *Tx) error {
+		_, err := tx.Get([]byte("key3"))
+		assert.Equal(t, ErrKeyNotFound, err)
+
+		err = bc.Put([]byte("key3"), []byte("val3"))
+		assert.Nil(t, err)
+
+		tx.Put([]byte("key3"), []byte("val4"))
+		return nil
+	})
+	assert.Equal(t, ErrConflict, err)
+
+	val, err := bc.Get([]byte("key3"))
+	assert.Nil(t, err)
+	assert.EqualValues(t, "val3", val)
+}
+
+func TestTxMerge(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	bc, err := New(
+		WithDirName(dirName),
+		WithSegmentSize(128), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+	defer bc.Close()
+
+	err = bc.Put([]byte("key1"), []byte("val1"))
+	assert.Nil(t, err)
+
+	// a merge moving the key read by the transaction isn't a conflict
+	err = bc.Update(func(tx *Tx) error {
+		val, err := tx.Get([]byte("key1"))
+		assert.Nil(t, err)
+
+		// rotate, so that key1 gets merged
+		err = bc.Put([]byte("filler"), make([]byte, 100))
+		assert.Nil(t, err)
+
+		err = bc.Merge(context.Background())
+		assert.Nil(t, err)
+
+		tx.Put([]byte("key2"), val)
+		return nil
+	})
+	assert.Nil(t, err)
+
+	val, err := bc.Get([]byte("key2"))
+	assert.Nil(t, err)
+	assert.EqualValues(t, "val1", val)
+}
+
+func TestTxConcurrentCounter(t *testing.T) {
+	dirName := "./test"
+	defer os.RemoveAll(dirName)
+
+	bc, err := New(
+		WithDirName(dirName),
+		WithSegmentSize(1024), // bytes
+		WithMergeOpt(&MergeOption{
+			Interval: 6 * time.Hour,
+		}),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, bc)
+	defer bc.Close()
+
+	increment := func(tx *Tx) error {
+		counter := 0
+
+		val, err := tx.Get([]byte("counter"))
+		if err == nil {
+			counter, err = strconv.Atoi(string(val))
+		}
+		if err != nil && err != ErrKeyNotFound {
+			return err
+		}
+
+		tx.Put([]byte("counter"), []byte(strconv.Itoa(counter+1)))
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < 50; i++ {
+				err := bc.Update(increment)
+				for err == ErrConflict {
+					err = bc.Update(increment)
+				}
+				assert.Nil(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	val, err := bc.Get([]byte("counter"))
+	assert.Nil(t, err)
+	assert.EqualValues(t, "400", val)
+}